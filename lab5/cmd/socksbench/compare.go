@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// compare starts the proxy binary twice, level-triggered and with -edge-triggered, runs the same
+// transfers against each and reports throughput together with the CPU time the proxy spent.
+// extra are proxy flags passed to both runs, e.g. -splice or -reactors 4.
+func compare(binary string, extra []string, modes []byte, targetPort int, size int64) error {
+	for _, variant := range []struct {
+		name  string
+		flags []string
+	}{{"level-triggered", nil}, {"edge-triggered", []string{"-edge-triggered"}}} {
+		fmt.Printf("== %s\n", variant.name)
+		port, err := freePort()
+		if err != nil {
+			return err
+		}
+		args := append(append(append([]string{}, extra...), variant.flags...), strconv.Itoa(port))
+		proxy := exec.Command(binary, args...)
+		proxy.Stderr = os.Stderr
+		if err := proxy.Start(); err != nil {
+			return err
+		}
+		*proxyAddr = net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+		err = waitListening(*proxyAddr)
+		if err == nil {
+			err = bench(modes, targetPort, size)
+		}
+		_ = proxy.Process.Signal(syscall.SIGTERM)
+		if waitErr := proxy.Wait(); err == nil && waitErr != nil {
+			err = fmt.Errorf("proxy: %v", waitErr)
+		}
+		if err != nil {
+			return err
+		}
+		state := proxy.ProcessState
+		cpu := state.UserTime() + state.SystemTime()
+		total := float64(size) * float64(*connsNum) * float64(len(modes))
+		fmt.Printf("proxy cpu: user %v, sys %v, %.2f s per GB relayed\n", state.UserTime().Round(time.Millisecond),
+			state.SystemTime().Round(time.Millisecond), cpu.Seconds()/(total/(1<<30)))
+	}
+	return nil
+}
+
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	_ = l.Close()
+	return port, nil
+}
+
+func waitListening(addr string) error {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c, err := net.Dial("tcp", addr)
+		if err == nil {
+			_ = c.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("proxy did not start listening on %s: %v", addr, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,253 @@
+// socksbench measures relay throughput of a running SOCKS5 proxy. It starts its own target server
+// on loopback and pushes data through the proxy over several parallel connections, e.g.
+//
+//	go run ./cmd/socksbench -proxy 127.0.0.1:1080 -conns 8 -size 256MB -mode both
+//
+// Run it once against the proxy started with -splice and once without to compare the relay paths.
+// With -compare it starts the given proxy binary itself, once level-triggered and once with
+// -edge-triggered, and also reports the CPU time the proxy used; arguments after the flags are
+// passed to the proxy:
+//
+//	go build -o /tmp/proxy . && go run ./cmd/socksbench -compare /tmp/proxy -conns 64 -- -splice
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	modeDownload = 'd'
+	modeUpload   = 'u'
+
+	chunkSize = 64 * 1024
+)
+
+var (
+	proxyAddr = flag.String("proxy", "127.0.0.1:1080", "SOCKS5 proxy address")
+	connsNum  = flag.Int("conns", 4, "number of parallel connections")
+	sizeFlag  = flag.String("size", "128MB", "bytes to transfer per connection and direction (KB, MB and GB suffixes)")
+	mode      = flag.String("mode", "both", "download, upload or both")
+	compareTo = flag.String("compare", "", "proxy binary to start in level- and edge-triggered mode and compare")
+)
+
+func main() {
+	flag.Parse()
+	size, err := parseSize(*sizeFlag)
+	if err != nil {
+		fmt.Printf("invalid size: %v\n", err)
+		os.Exit(1)
+	}
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Printf("listen faile: %v\n", err)
+		os.Exit(1)
+	}
+	go serveTarget(target)
+	targetPort := target.Addr().(*net.TCPAddr).Port
+
+	var modes []byte
+	switch *mode {
+	case "download":
+		modes = []byte{modeDownload}
+	case "upload":
+		modes = []byte{modeUpload}
+	case "both":
+		modes = []byte{modeDownload, modeUpload}
+	default:
+		fmt.Printf("unknown mode %q\n", *mode)
+		os.Exit(1)
+	}
+
+	if *compareTo != "" {
+		err = compare(*compareTo, flag.Args(), modes, targetPort, size)
+	} else {
+		err = bench(modes, targetPort, size)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func bench(modes []byte, targetPort int, size int64) error {
+	for _, m := range modes {
+		elapsed, err := run(m, targetPort, size)
+		if err != nil {
+			return fmt.Errorf("%s: %v", modeName(m), err)
+		}
+		total := float64(size) * float64(*connsNum)
+		fmt.Printf("%-8s %d conns x %s: %v, %.1f MB/s\n", modeName(m), *connsNum, *sizeFlag,
+			elapsed.Round(time.Millisecond), total/elapsed.Seconds()/(1<<20))
+	}
+	return nil
+}
+
+func run(m byte, targetPort int, size int64) (time.Duration, error) {
+	conns := make([]net.Conn, 0, *connsNum)
+	defer func() {
+		for _, c := range conns {
+			_ = c.Close()
+		}
+	}()
+	for i := 0; i < *connsNum; i++ {
+		c, err := dialSocks(*proxyAddr, targetPort)
+		if err != nil {
+			return 0, err
+		}
+		conns = append(conns, c)
+	}
+
+	start := time.Now()
+	errs := make(chan error, len(conns))
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c net.Conn) {
+			defer wg.Done()
+			errs <- transfer(c, m, size)
+		}(c)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return 0, err
+		}
+	}
+	return elapsed, nil
+}
+
+func transfer(c net.Conn, m byte, size int64) error {
+	header := make([]byte, 9)
+	header[0] = m
+	binary.BigEndian.PutUint64(header[1:], uint64(size))
+	if _, err := c.Write(header); err != nil {
+		return err
+	}
+
+	if m == modeDownload {
+		n, err := io.Copy(io.Discard, c)
+		if err != nil {
+			return err
+		}
+		if n != size {
+			return fmt.Errorf("received %d of %d bytes", n, size)
+		}
+		return nil
+	}
+
+	if err := writeN(c, size); err != nil {
+		return err
+	}
+	ack := make([]byte, 1)
+	_, err := io.ReadFull(c, ack)
+	return err
+}
+
+// dialSocks performs a no-auth SOCKS5 CONNECT to 127.0.0.1:port.
+func dialSocks(proxy string, port int) (net.Conn, error) {
+	c, err := net.Dial("tcp", proxy)
+	if err != nil {
+		return nil, err
+	}
+	reply := make([]byte, 10)
+	if _, err = c.Write([]byte{0x05, 0x01, 0x00}); err == nil {
+		_, err = io.ReadFull(c, reply[:2])
+	}
+	if err == nil && reply[1] != 0x00 {
+		err = errors.New("proxy requires authentication")
+	}
+	if err == nil {
+		request := []byte{0x05, 0x01, 0x00, 0x01, 127, 0, 0, 1, 0, 0}
+		binary.BigEndian.PutUint16(request[8:], uint16(port))
+		if _, err = c.Write(request); err == nil {
+			_, err = io.ReadFull(c, reply)
+		}
+	}
+	if err == nil && reply[1] != 0x00 {
+		err = fmt.Errorf("connect rejected with 0x%02x", reply[1])
+	}
+	if err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func serveTarget(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func(c net.Conn) {
+			defer c.Close()
+			header := make([]byte, 9)
+			if _, err := io.ReadFull(c, header); err != nil {
+				return
+			}
+			size := int64(binary.BigEndian.Uint64(header[1:]))
+			if header[0] == modeDownload {
+				_ = writeN(c, size)
+				return
+			}
+			if _, err := io.CopyN(io.Discard, c, size); err == nil {
+				_, _ = c.Write([]byte{1})
+			}
+		}(c)
+	}
+}
+
+func writeN(w io.Writer, size int64) error {
+	chunk := make([]byte, chunkSize)
+	for size > 0 {
+		n := int64(len(chunk))
+		if size < n {
+			n = size
+		}
+		if _, err := w.Write(chunk[:n]); err != nil {
+			return err
+		}
+		size -= n
+	}
+	return nil
+}
+
+func parseSize(s string) (int64, error) {
+	multiplier := int64(1)
+	upper := strings.ToUpper(s)
+	for _, suffix := range []struct {
+		name  string
+		value int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}} {
+		if strings.HasSuffix(upper, suffix.name) {
+			multiplier = suffix.value
+			upper = strings.TrimSuffix(upper, suffix.name)
+			break
+		}
+	}
+	n, err := strconv.ParseInt(upper, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return n * multiplier, nil
+}
+
+func modeName(m byte) string {
+	if m == modeDownload {
+		return "download"
+	}
+	return "upload"
+}
@@ -2,4 +2,7 @@ module lab5
 
 go 1.25
 
-require golang.org/x/sys v0.38.0
+require (
+	golang.org/x/crypto v0.45.0
+	golang.org/x/sys v0.38.0
+)
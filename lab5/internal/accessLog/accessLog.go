@@ -0,0 +1,183 @@
+package accessLog
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Record describes one client connection; it is written as a JSON line when the connection closes.
+type Record struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	User      string    `json:"user,omitempty"`
+	Protocol  string    `json:"protocol"`
+	Command   string    `json:"command,omitempty"`
+	Atyp      string    `json:"atyp,omitempty"`
+	Host      string    `json:"host,omitempty"`
+	Port      int       `json:"port,omitempty"`
+	Upstream  string    `json:"upstream,omitempty"`
+	Reply     string    `json:"reply,omitempty"`
+	BytesUp   uint64    `json:"bytes_up"`
+	BytesDown uint64    `json:"bytes_down"`
+	Handshake float64   `json:"handshake_seconds"`
+	Resolve   float64   `json:"resolve_seconds,omitempty"`
+	Connect   float64   `json:"connect_seconds,omitempty"`
+	Relay     float64   `json:"relay_seconds,omitempty"`
+	Duration  float64   `json:"duration_seconds"`
+}
+
+const (
+	queueSize     = 4096
+	flushInterval = time.Second
+)
+
+var (
+	records chan Record
+	done    sync.WaitGroup
+	dropped atomic.Uint64
+)
+
+// Enabled reports whether records are collected; reactors skip building them otherwise.
+func Enabled() bool {
+	return records != nil
+}
+
+// Dropped counts records lost because the writer could not keep up.
+func Dropped() uint64 {
+	return dropped.Load()
+}
+
+// Log hands a record to the writer goroutine. It never blocks the event loop: when the queue is
+// full the record is dropped and counted.
+func Log(record Record) {
+	select {
+	case records <- record:
+	default:
+		dropped.Add(1)
+	}
+}
+
+// Open starts the writer. path "-" means stdout; a file is rotated to path.1 ... path.<backups>
+// once it grows past maxSize bytes (0 disables rotation).
+func Open(path string, maxSize int64, backups int) error {
+	var sink *sink
+	if path == "-" {
+		sink = newSink(nopCloser{os.Stdout}, "", 0, 0, 0)
+	} else {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			_ = file.Close()
+			return err
+		}
+		sink = newSink(file, path, info.Size(), maxSize, backups)
+	}
+	records = make(chan Record, queueSize)
+	done.Add(1)
+	go sink.run(records)
+	return nil
+}
+
+// Close writes out the queued records; it must be called after the reactors have stopped.
+func Close() {
+	if records == nil {
+		return
+	}
+	close(records)
+	done.Wait()
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+type sink struct {
+	out     io.WriteCloser
+	writer  *bufio.Writer
+	path    string
+	size    int64
+	maxSize int64
+	backups int
+}
+
+func newSink(out io.WriteCloser, path string, size int64, maxSize int64, backups int) *sink {
+	return &sink{out: out, writer: bufio.NewWriter(out), path: path, size: size, maxSize: maxSize, backups: backups}
+}
+
+func (s *sink) run(records <-chan Record) {
+	defer done.Done()
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case record, ok := <-records:
+			if !ok {
+				s.flush()
+				if err := s.out.Close(); err != nil {
+					fmt.Printf("access log close faile: %v\n", err)
+				}
+				return
+			}
+			s.write(record)
+		case <-ticker.C:
+			s.flush()
+		}
+	}
+}
+
+func (s *sink) write(record Record) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	n, err := s.writer.Write(line)
+	s.size += int64(n)
+	if err != nil {
+		fmt.Printf("access log write faile: %v\n", err)
+		return
+	}
+	if s.maxSize > 0 && s.size >= s.maxSize {
+		s.rotate()
+	}
+}
+
+func (s *sink) flush() {
+	if err := s.writer.Flush(); err != nil {
+		fmt.Printf("access log write faile: %v\n", err)
+	}
+}
+
+// rotate shifts path.N-1 -> path.N ... path -> path.1 and starts a new file.
+func (s *sink) rotate() {
+	s.flush()
+	if err := s.out.Close(); err != nil {
+		fmt.Printf("access log close faile: %v\n", err)
+	}
+	for i := s.backups - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+	}
+	if s.backups > 0 {
+		_ = os.Rename(s.path, s.path+".1")
+	} else {
+		_ = os.Remove(s.path)
+	}
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		fmt.Printf("access log reopen faile: %v\n", err)
+		s.out = nopCloser{io.Discard}
+	} else {
+		s.out = file
+	}
+	s.writer.Reset(s.out)
+	s.size = 0
+}
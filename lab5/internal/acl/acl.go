@@ -0,0 +1,184 @@
+package acl
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// rule is one line of the rules file: action, client, destination and ports.
+type rule struct {
+	allow   bool
+	client  *net.IPNet
+	dest    Destination
+	portMin int
+	portMax int
+}
+
+// RuleSet is evaluated top to bottom, the first matching rule wins and a request that matches
+// no rule is denied.
+type RuleSet struct {
+	rules []rule
+}
+
+// rules is nil when the proxy runs without access control. It is shared by all reactors and
+// replaced as a whole on reload.
+var rules atomic.Pointer[RuleSet]
+
+func SetRules(rs *RuleSet) {
+	rules.Store(rs)
+}
+
+func (rs *RuleSet) Len() int {
+	return len(rs.rules)
+}
+
+// Load reads lines of the form "allow|deny <client> <destination> <ports>", where client is a
+// CIDR or IP, destination is a CIDR, IP or domain glob (*.example.com), ports is N or N-M, and
+// "*" matches anything.
+func Load(filePath string) (*RuleSet, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+
+	rs := &RuleSet{}
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		parsed, err := parseRule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filePath, lineNum, err)
+		}
+		rs.rules = append(rs.rules, parsed)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+func parseRule(fields []string) (rule, error) {
+	var r rule
+	if len(fields) != 4 {
+		return r, fmt.Errorf("expected: allow|deny <client> <destination> <ports>")
+	}
+
+	switch fields[0] {
+	case "allow":
+		r.allow = true
+	case "deny":
+	default:
+		return r, fmt.Errorf("unknown action %q", fields[0])
+	}
+
+	if fields[1] != "*" {
+		client, err := ParseNet(fields[1])
+		if err != nil {
+			return r, fmt.Errorf("client: %v", err)
+		}
+		r.client = client
+	}
+
+	dest, err := ParseDestination(fields[2])
+	if err != nil {
+		return r, fmt.Errorf("destination: %v", err)
+	}
+	r.dest = dest
+
+	r.portMin, r.portMax = 0, 65535
+	if fields[3] != "*" {
+		low, high, isRange := strings.Cut(fields[3], "-")
+		if !isRange {
+			high = low
+		}
+		if r.portMin, err = strconv.Atoi(low); err != nil {
+			return r, fmt.Errorf("ports: %v", err)
+		}
+		if r.portMax, err = strconv.Atoi(high); err != nil {
+			return r, fmt.Errorf("ports: %v", err)
+		}
+		if r.portMin < 0 || r.portMax > 65535 || r.portMin > r.portMax {
+			return r, fmt.Errorf("ports: bad range %q", fields[3])
+		}
+	}
+	return r, nil
+}
+
+// Allowed decides whether client may reach the destination. For a domain that is not resolved
+// yet ip is nil: when rules on destination networks could still change the outcome the request
+// is let through to resolution and every resolved address has to be checked again.
+func Allowed(client net.IP, domain string, ip net.IP, port int) bool {
+	allowed, decided := Check(client, domain, ip, port)
+	return allowed || !decided
+}
+
+// Check evaluates the rules like Allowed but also reports whether the result is final. Rules on
+// destination networks are skipped while ip is nil; decided is false when one of them comes
+// before the rule that matched and has the opposite action.
+func Check(client net.IP, domain string, ip net.IP, port int) (allowed bool, decided bool) {
+	rs := rules.Load()
+	if rs == nil {
+		return true, true
+	}
+	skippedAllow, skippedDeny := false, false
+	for i := range rs.rules {
+		rule := &rs.rules[i]
+		if rule.client != nil && (client == nil || !rule.client.Contains(client)) {
+			continue
+		}
+		if port < rule.portMin || port > rule.portMax {
+			continue
+		}
+		if rule.dest.IsNetwork() && ip == nil {
+			if rule.allow {
+				skippedAllow = true
+			} else {
+				skippedDeny = true
+			}
+			continue
+		}
+		if !rule.dest.Match(domain, ip) {
+			continue
+		}
+		if rule.allow {
+			return true, !skippedDeny
+		}
+		return false, !skippedAllow
+	}
+	return false, !skippedAllow
+}
+
+// ClientAllowed is the check for commands without a known destination (BIND and UDP ASSOCIATE):
+// it fails when no allow rule applies to the client before a deny rule that covers every
+// destination and port.
+func ClientAllowed(client net.IP) bool {
+	rs := rules.Load()
+	if rs == nil {
+		return true
+	}
+	for i := range rs.rules {
+		rule := &rs.rules[i]
+		if rule.client != nil && (client == nil || !rule.client.Contains(client)) {
+			continue
+		}
+		if rule.allow {
+			return true
+		}
+		if rule.dest == (Destination{}) && rule.portMin == 0 && rule.portMax == 65535 {
+			return false
+		}
+	}
+	return false
+}
@@ -0,0 +1,186 @@
+package acl
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func setTestRules(t *testing.T, lines ...string) {
+	t.Helper()
+	t.Cleanup(func() { SetRules(nil) })
+	if len(lines) == 0 {
+		SetRules(nil)
+		return
+	}
+	rs := &RuleSet{}
+	for _, line := range lines {
+		parsed, err := parseRule(strings.Fields(line))
+		if err != nil {
+			t.Fatalf("parseRule(%q): %v", line, err)
+		}
+		rs.rules = append(rs.rules, parsed)
+	}
+	SetRules(rs)
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []string
+		client  string
+		domain  string
+		ip      string
+		port    int
+		allowed bool
+		decided bool
+	}{
+		{
+			name:   "no rules",
+			client: "192.168.1.1", ip: "10.0.0.1", port: 80,
+			allowed: true, decided: true,
+		},
+		{
+			name:   "no match is denied",
+			rules:  []string{"allow 192.168.0.0/16 * *"},
+			client: "172.16.0.1", ip: "10.0.0.1", port: 80,
+			allowed: false, decided: true,
+		},
+		{
+			name:   "first match wins",
+			rules:  []string{"deny * 10.0.0.0/8 *", "allow * * *"},
+			client: "192.168.1.1", ip: "10.1.2.3", port: 80,
+			allowed: false, decided: true,
+		},
+		{
+			name:   "later rule after a miss",
+			rules:  []string{"deny * 10.0.0.0/8 *", "allow * * *"},
+			client: "192.168.1.1", ip: "8.8.8.8", port: 80,
+			allowed: true, decided: true,
+		},
+		{
+			name:   "client network",
+			rules:  []string{"allow 192.168.0.0/16 * *", "deny * * *"},
+			client: "192.168.5.5", ip: "8.8.8.8", port: 80,
+			allowed: true, decided: true,
+		},
+		{
+			name:   "cidr rule then glob deny for an unresolved domain",
+			rules:  []string{"deny * 10.0.0.0/8 *", "deny * *.evil.com *", "allow * * *"},
+			client: "192.168.1.1", domain: "x.evil.com", port: 443,
+			allowed: false, decided: true,
+		},
+		{
+			name:   "cidr allow then glob deny for an unresolved domain",
+			rules:  []string{"allow * 10.0.0.0/8 *", "deny * *.evil.com *"},
+			client: "192.168.1.1", domain: "x.evil.com", port: 443,
+			allowed: false, decided: false,
+		},
+		{
+			name:   "cidr deny then allow for an unresolved domain",
+			rules:  []string{"deny * 10.0.0.0/8 *", "allow * * *"},
+			client: "192.168.1.1", domain: "example.com", port: 443,
+			allowed: true, decided: false,
+		},
+		{
+			name:   "resolved domain is checked against networks",
+			rules:  []string{"deny * 10.0.0.0/8 *", "allow * * *"},
+			client: "192.168.1.1", domain: "example.com", ip: "10.0.0.1", port: 443,
+			allowed: false, decided: true,
+		},
+		{
+			name:   "glob is case insensitive and ignores the trailing dot",
+			rules:  []string{"allow * *.example.com *"},
+			client: "192.168.1.1", domain: "WWW.Example.com.", port: 443,
+			allowed: true, decided: true,
+		},
+		{
+			name:   "glob does not match an address",
+			rules:  []string{"allow * *.example.com *"},
+			client: "192.168.1.1", ip: "93.184.216.34", port: 443,
+			allowed: false, decided: true,
+		},
+		{
+			name:   "port range low end",
+			rules:  []string{"allow * * 80-443"},
+			client: "192.168.1.1", ip: "8.8.8.8", port: 80,
+			allowed: true, decided: true,
+		},
+		{
+			name:   "port range high end",
+			rules:  []string{"allow * * 80-443"},
+			client: "192.168.1.1", ip: "8.8.8.8", port: 443,
+			allowed: true, decided: true,
+		},
+		{
+			name:   "port outside the range",
+			rules:  []string{"allow * * 80-443"},
+			client: "192.168.1.1", ip: "8.8.8.8", port: 444,
+			allowed: false, decided: true,
+		},
+		{
+			name:   "single port",
+			rules:  []string{"deny * * 25", "allow * * *"},
+			client: "192.168.1.1", ip: "8.8.8.8", port: 25,
+			allowed: false, decided: true,
+		},
+		{
+			name:   "cidr rule on another port is not skipped",
+			rules:  []string{"allow * 10.0.0.0/8 22", "deny * *.evil.com *"},
+			client: "192.168.1.1", domain: "x.evil.com", port: 443,
+			allowed: false, decided: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestRules(t, tt.rules...)
+			allowed, decided := Check(net.ParseIP(tt.client), tt.domain, net.ParseIP(tt.ip), tt.port)
+			if allowed != tt.allowed || decided != tt.decided {
+				t.Errorf("Check() = %v, %v; want %v, %v", allowed, decided, tt.allowed, tt.decided)
+			}
+			if got, want := Allowed(net.ParseIP(tt.client), tt.domain, net.ParseIP(tt.ip), tt.port), tt.allowed || !tt.decided; got != want {
+				t.Errorf("Allowed() = %v; want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestClientAllowed(t *testing.T) {
+	tests := []struct {
+		name   string
+		rules  []string
+		client string
+		want   bool
+	}{
+		{"no rules", nil, "10.0.0.1", true},
+		{"denied client", []string{"deny 10.0.0.0/8 * *", "allow * * *"}, "10.0.0.1", false},
+		{"other client", []string{"deny 10.0.0.0/8 * *", "allow * * *"}, "192.168.1.1", true},
+		{"narrow deny does not decide", []string{"deny 10.0.0.0/8 * 25", "allow * * *"}, "10.0.0.1", true},
+		{"some allow applies", []string{"allow 10.0.0.0/8 *.example.com 443", "deny * * *"}, "10.0.0.1", true},
+		{"no rule applies", []string{"allow 192.168.0.0/16 * *"}, "10.0.0.1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestRules(t, tt.rules...)
+			if got := ClientAllowed(net.ParseIP(tt.client)); got != tt.want {
+				t.Errorf("ClientAllowed(%s) = %v; want %v", tt.client, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	for _, line := range []string{
+		"permit * * *",
+		"allow * *",
+		"allow 10.0.0.300 * *",
+		"allow * * 443-80",
+		"allow * * 70000",
+		"allow * * x",
+		"allow * [ *",
+	} {
+		if _, err := parseRule(strings.Fields(line)); err == nil {
+			t.Errorf("parseRule(%q) succeeded", line)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package acl
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+)
+
+// Destination is a CIDR, a single IP or a domain glob such as *.example.com; the zero value
+// ("*" in rule files) matches anything.
+type Destination struct {
+	network *net.IPNet
+	glob    string
+}
+
+func ParseDestination(s string) (Destination, error) {
+	if s == "*" {
+		return Destination{}, nil
+	}
+	if network, err := ParseNet(s); err == nil {
+		return Destination{network: network}, nil
+	}
+	glob := normalizeDomain(s)
+	if _, err := path.Match(glob, ""); err != nil {
+		return Destination{}, fmt.Errorf("bad glob %q", s)
+	}
+	return Destination{glob: glob}, nil
+}
+
+// IsNetwork reports whether the destination can only be matched against an IP address.
+func (d Destination) IsNetwork() bool {
+	return d.network != nil
+}
+
+// Match checks a request for a domain (ip is nil until it is resolved) or for an address
+// (domain is empty). Networks never match an unresolved domain and globs never match an address.
+func (d Destination) Match(domain string, ip net.IP) bool {
+	switch {
+	case d.network != nil:
+		return ip != nil && d.network.Contains(ip)
+	case d.glob != "":
+		if domain == "" {
+			return false
+		}
+		matched, _ := path.Match(d.glob, normalizeDomain(domain))
+		return matched
+	}
+	return true
+}
+
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
+
+// ParseNet accepts a CIDR or a single IP, which becomes a /32 or /128 network.
+func ParseNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		return network, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("bad address %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// CredentialStore checks username/password pairs for the RFC 1929 sub-negotiation.
+type CredentialStore interface {
+	Verify(username, password string) bool
+}
+
+// Store is nil when the proxy runs without authentication.
+var Store CredentialStore
+
+// HtpasswdStore is shared by all reactors; Reload swaps the users map as a whole.
+type HtpasswdStore struct {
+	users atomic.Pointer[map[string][]byte]
+}
+
+// LoadHtpasswd reads "user:hash" lines; only bcrypt hashes ($2a$, $2b$, $2y$) are accepted.
+func LoadHtpasswd(path string) (*HtpasswdStore, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok || username == "" {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", path, lineNum)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s:%d: unsupported hash for %q: %v", path, lineNum, username, err)
+		}
+		users[username] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	store := &HtpasswdStore{}
+	store.users.Store(&users)
+	return store, nil
+}
+
+// Reload re-reads the file; on error the current users stay in place.
+func (s *HtpasswdStore) Reload(path string) (int, error) {
+	loaded, err := LoadHtpasswd(path)
+	if err != nil {
+		return 0, err
+	}
+	users := loaded.users.Load()
+	s.users.Store(users)
+	return len(*users), nil
+}
+
+func (s *HtpasswdStore) Verify(username, password string) bool {
+	hash, ok := (*s.users.Load())[username]
+	if !ok {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"runtime"
+	"sync"
+)
+
+// queueSize bounds the checks waiting for a worker; a client that finds the queue full is refused
+// instead of waiting behind everybody else.
+const queueSize = 256
+
+type job struct {
+	username string
+	password string
+	done     func(ok bool)
+}
+
+var (
+	jobs    chan job
+	workers sync.WaitGroup
+)
+
+// StartWorkers runs the password checks. bcrypt takes tens of milliseconds per check, so it must
+// never run on a reactor: one slow check would stall every connection of that reactor.
+func StartWorkers() {
+	jobs = make(chan job, queueSize)
+	for i := 0; i < runtime.NumCPU(); i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for j := range jobs {
+				j.done(Store.Verify(j.username, j.password))
+			}
+		}()
+	}
+}
+
+// VerifyAsync queues a check and reports false when the queue is full. done is called on a
+// worker goroutine, so it has to hand the result back to the reactor itself.
+func VerifyAsync(username, password string, done func(ok bool)) bool {
+	select {
+	case jobs <- job{username: username, password: password, done: done}:
+		return true
+	default:
+		return false
+	}
+}
+
+// StopWorkers finishes the queued checks; it must be called after the reactors have stopped.
+func StopWorkers() {
+	if jobs == nil {
+		return
+	}
+	close(jobs)
+	workers.Wait()
+}
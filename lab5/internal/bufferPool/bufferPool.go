@@ -0,0 +1,124 @@
+package bufferPool
+
+// ChunkSize is the unit in which relay buffers take memory from the pool.
+const ChunkSize = 16 * 1024
+
+// maxFreeChunks bounds how much released memory a pool keeps for reuse.
+const maxFreeChunks = 256
+
+// Pool hands out fixed-size chunks to the connections of one reactor. It is not safe for
+// concurrent use; every reactor owns its own pool.
+type Pool struct {
+	free   [][]byte
+	inUse  int
+	budget int
+}
+
+// New creates a pool; budget is the number of bytes connections may hold, 0 means no limit.
+func New(budget int) *Pool {
+	return &Pool{budget: budget}
+}
+
+func (p *Pool) get() []byte {
+	p.inUse++
+	if n := len(p.free); n > 0 {
+		chunk := p.free[n-1]
+		p.free[n-1] = nil
+		p.free = p.free[:n-1]
+		return chunk
+	}
+	return make([]byte, ChunkSize)
+}
+
+func (p *Pool) put(chunk []byte) {
+	p.inUse--
+	if len(p.free) < maxFreeChunks {
+		p.free = append(p.free, chunk)
+	}
+}
+
+// InUse reports the bytes currently held by connection buffers.
+func (p *Pool) InUse() int {
+	return p.inUse * ChunkSize
+}
+
+// Exhausted reports whether the budget is used up; buffers keep growing past it so established
+// connections are never cut, but no new connections should be taken on.
+func (p *Pool) Exhausted() bool {
+	return p.budget > 0 && p.InUse() >= p.budget
+}
+
+// Queue is a FIFO byte buffer made of pool chunks. An empty queue holds no chunks at all.
+type Queue struct {
+	pool   *Pool
+	chunks [][]byte
+	head   int
+	tail   int
+	length int
+}
+
+func NewQueue(pool *Pool) Queue {
+	return Queue{pool: pool}
+}
+
+func (q *Queue) Len() int {
+	return q.length
+}
+
+func (q *Queue) Write(b []byte) {
+	for len(b) > 0 {
+		if len(q.chunks) == 0 || q.tail == ChunkSize {
+			q.chunks = append(q.chunks, q.pool.get())
+			q.tail = 0
+		}
+		n := copy(q.chunks[len(q.chunks)-1][q.tail:], b)
+		q.tail += n
+		q.length += n
+		b = b[n:]
+	}
+}
+
+// Bytes returns the unread part of the first chunk, which is what a single write(2) can send.
+func (q *Queue) Bytes() []byte {
+	if len(q.chunks) == 0 {
+		return nil
+	}
+	if len(q.chunks) == 1 {
+		return q.chunks[0][q.head:q.tail]
+	}
+	return q.chunks[0][q.head:]
+}
+
+// Next discards n bytes from the front and returns drained chunks to the pool.
+func (q *Queue) Next(n int) {
+	for n > 0 && len(q.chunks) > 0 {
+		available := len(q.Bytes())
+		if n < available {
+			q.head += n
+			q.length -= n
+			return
+		}
+		n -= available
+		q.length -= available
+		q.releaseFirst()
+	}
+}
+
+func (q *Queue) releaseFirst() {
+	q.pool.put(q.chunks[0])
+	q.chunks[0] = nil
+	q.chunks = q.chunks[1:]
+	q.head = 0
+	if len(q.chunks) == 0 {
+		q.chunks = nil
+		q.tail = 0
+	}
+}
+
+// Reset returns every chunk to the pool.
+func (q *Queue) Reset() {
+	for len(q.chunks) > 0 {
+		q.releaseFirst()
+	}
+	q.length = 0
+}
@@ -0,0 +1,111 @@
+package bufferPool
+
+import (
+	"bytes"
+	"testing"
+)
+
+func pattern(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}
+
+// drain reads the queue the way a writer does, one Bytes slice at a time, at most step bytes each.
+func drain(q *Queue, step int) []byte {
+	var out []byte
+	for q.Len() > 0 {
+		chunk := q.Bytes()
+		n := min(len(chunk), step)
+		out = append(out, chunk[:n]...)
+		q.Next(n)
+	}
+	return out
+}
+
+func TestQueueAcrossChunks(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []int
+		step   int
+	}{
+		{name: "one byte", writes: []int{1}, step: 1},
+		{name: "exactly one chunk", writes: []int{ChunkSize}, step: ChunkSize},
+		{name: "one byte past a chunk", writes: []int{ChunkSize + 1}, step: ChunkSize},
+		{name: "write spanning three chunks", writes: []int{3*ChunkSize - 7}, step: 4096},
+		{name: "small writes across a boundary", writes: []int{ChunkSize - 3, 2, 2, 2}, step: 5},
+		{name: "reads not aligned to chunks", writes: []int{1000, 2 * ChunkSize, 1000}, step: 3000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := New(0)
+			q := NewQueue(pool)
+			var want []byte
+			for _, n := range tt.writes {
+				b := pattern(n)
+				q.Write(b)
+				want = append(want, b...)
+			}
+			if q.Len() != len(want) {
+				t.Fatalf("Len() = %d; want %d", q.Len(), len(want))
+			}
+			if chunks := (len(want) + ChunkSize - 1) / ChunkSize; pool.InUse() != chunks*ChunkSize {
+				t.Errorf("InUse() = %d; want %d chunks", pool.InUse(), chunks)
+			}
+			if got := drain(&q, tt.step); !bytes.Equal(got, want) {
+				t.Errorf("drained %d bytes, differ from the %d written", len(got), len(want))
+			}
+			if q.Len() != 0 || q.Bytes() != nil || pool.InUse() != 0 {
+				t.Errorf("drained queue: Len() %d, Bytes() %v, InUse() %d", q.Len(), q.Bytes(), pool.InUse())
+			}
+		})
+	}
+}
+
+func TestQueueInterleaved(t *testing.T) {
+	pool := New(0)
+	q := NewQueue(pool)
+	var want, got []byte
+	for i := 0; i < 50; i++ {
+		b := pattern(5000 + i)
+		q.Write(b)
+		want = append(want, b...)
+		chunk := q.Bytes()
+		n := min(len(chunk), 4000)
+		got = append(got, chunk[:n]...)
+		q.Next(n)
+	}
+	got = append(got, drain(&q, ChunkSize)...)
+	if !bytes.Equal(got, want) {
+		t.Errorf("read %d bytes, differ from the %d written", len(got), len(want))
+	}
+	if pool.InUse() != 0 {
+		t.Errorf("InUse() = %d after draining", pool.InUse())
+	}
+}
+
+func TestQueueReset(t *testing.T) {
+	pool := New(2 * ChunkSize)
+	q := NewQueue(pool)
+	q.Write(pattern(ChunkSize))
+	if pool.Exhausted() {
+		t.Fatal("exhausted at half the budget")
+	}
+	q.Write(pattern(ChunkSize))
+	if !pool.Exhausted() {
+		t.Fatal("not exhausted at the budget")
+	}
+	q.Reset()
+	if q.Len() != 0 || pool.InUse() != 0 || pool.Exhausted() {
+		t.Errorf("after Reset: Len() %d, InUse() %d, Exhausted() %v", q.Len(), pool.InUse(), pool.Exhausted())
+	}
+	if len(pool.free) != 2 {
+		t.Errorf("%d free chunks; want 2", len(pool.free))
+	}
+	q.Write(pattern(10))
+	if len(pool.free) != 1 {
+		t.Errorf("released chunk not reused, %d free", len(pool.free))
+	}
+}
@@ -0,0 +1,255 @@
+package chain
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"lab5/internal/data"
+	"lab5/internal/utils"
+	"net"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	stepSocksMethod = iota
+	stepSocksAuth
+	stepSocksReply
+	stepHTTPResponse
+)
+
+const (
+	socksReplyHeaderSize = 4
+	maxHTTPResponseSize  = 4 * 1024
+)
+
+// Start begins the handshake with the parent proxy once the upstream socket has connected to it.
+func Start(r *data.Reactor, conn *data.Conn) {
+	ch := conn.Chain
+	conn.State = data.StateChaining
+	if ch.IsHTTP {
+		target := net.JoinHostPort(ch.Host, strconv.Itoa(ch.Port))
+		request := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", target, target)
+		if ch.Username != "" {
+			credentials := base64.StdEncoding.EncodeToString([]byte(ch.Username + ":" + ch.Password))
+			request += "Proxy-Authorization: Basic " + credentials + "\r\n"
+		}
+		ch.Out = []byte(request + "\r\n")
+		ch.Step = stepHTTPResponse
+	} else {
+		if ch.Username != "" {
+			ch.Out = []byte{data.SocksVer, 2, data.SocksMethodNoAuth, data.SocksMethodUserPass}
+		} else {
+			ch.Out = []byte{data.SocksVer, 1, data.SocksMethodNoAuth}
+		}
+		ch.Step = stepSocksMethod
+	}
+	Flush(r, conn)
+}
+
+// Flush writes the pending handshake message to the parent proxy.
+func Flush(r *data.Reactor, conn *data.Conn) {
+	ch := conn.Chain
+	for len(ch.Out) > 0 {
+		n, err := unix.Write(conn.UpstreamFD, ch.Out)
+		if n > 0 {
+			ch.Out = ch.Out[n:]
+		}
+		if err != nil {
+			if errors.Is(err, unix.EAGAIN) {
+				utils.UpdateUpstreamEvents(r, conn)
+				return
+			}
+			fail(r, conn, data.RepGeneralFailure)
+			return
+		}
+	}
+	utils.UpdateUpstreamEvents(r, conn)
+}
+
+// Read advances the handshake with the parent's answers and reports whether the tunnel is ready.
+// The answers are collected in the handshake's own buffer; bytes the parent sent after its final
+// reply are already relayed data and are returned for the client.
+func Read(r *data.Reactor, conn *data.Conn) ([]byte, bool) {
+	ch := conn.Chain
+	buffer := r.ReadBuffer[:maxHTTPResponseSize]
+	for {
+		n, err := unix.Read(conn.UpstreamFD, buffer)
+		if err != nil {
+			if !errors.Is(err, unix.EAGAIN) {
+				fail(r, conn, data.RepGeneralFailure)
+			}
+			return nil, false
+		}
+		if n == 0 {
+			fail(r, conn, data.RepGeneralFailure)
+			return nil, false
+		}
+		ch.In = append(ch.In, buffer[:n]...)
+
+		for {
+			step := ch.Step
+			done, rep := consume(ch)
+			if rep != data.RepSuccess {
+				fail(r, conn, rep)
+				return nil, false
+			}
+			if !done {
+				break
+			}
+			if step == stepHTTPResponse || step == stepSocksReply {
+				conn.Chain = nil
+				return ch.In, true
+			}
+			if len(ch.Out) > 0 {
+				Flush(r, conn)
+				if conn.ClientFD < 0 {
+					return nil, false
+				}
+			}
+		}
+	}
+}
+
+// consume parses the answer to the current step from ch.In and drops it from the input. It reports
+// whether the whole answer was there and the reply code for the client, RepSuccess unless the parent
+// refused.
+func consume(ch *data.ChainHandshake) (bool, byte) {
+	var used int
+	var rep byte
+	switch ch.Step {
+	case stepSocksMethod:
+		used, rep = readSocksMethod(ch, ch.In)
+	case stepSocksAuth:
+		used, rep = readSocksAuth(ch, ch.In)
+	case stepSocksReply:
+		used, rep = readSocksReply(ch, ch.In)
+	case stepHTTPResponse:
+		used, rep = readHTTPResponse(ch.In)
+	}
+	if rep != data.RepSuccess || used == 0 {
+		return false, rep
+	}
+	ch.In = ch.In[used:]
+	return true, data.RepSuccess
+}
+
+// The read helpers return how many bytes the answer took (0 while it is incomplete) and the
+// reply code for the client, RepSuccess unless the parent refused.
+
+func readSocksMethod(ch *data.ChainHandshake, answer []byte) (int, byte) {
+	if len(answer) < 2 {
+		return 0, data.RepSuccess
+	}
+	if answer[0] != data.SocksVer {
+		return 0, data.RepGeneralFailure
+	}
+	switch {
+	case answer[1] == data.SocksMethodNoAuth:
+		ch.Out = socksRequest(ch)
+		ch.Step = stepSocksReply
+	case answer[1] == data.SocksMethodUserPass && ch.Username != "":
+		ch.Out = []byte{data.AuthVer, byte(len(ch.Username))}
+		ch.Out = append(ch.Out, ch.Username...)
+		ch.Out = append(ch.Out, byte(len(ch.Password)))
+		ch.Out = append(ch.Out, ch.Password...)
+		ch.Step = stepSocksAuth
+	default:
+		return 0, data.RepGeneralFailure
+	}
+	return 2, data.RepSuccess
+}
+
+func readSocksAuth(ch *data.ChainHandshake, answer []byte) (int, byte) {
+	if len(answer) < 2 {
+		return 0, data.RepSuccess
+	}
+	if answer[1] != data.AuthStatusSuccess {
+		return 0, data.RepGeneralFailure
+	}
+	ch.Out = socksRequest(ch)
+	ch.Step = stepSocksReply
+	return 2, data.RepSuccess
+}
+
+func readSocksReply(ch *data.ChainHandshake, answer []byte) (int, byte) {
+	if len(answer) < socksReplyHeaderSize+1 {
+		return 0, data.RepSuccess
+	}
+	if answer[0] != data.SocksVer {
+		return 0, data.RepGeneralFailure
+	}
+	if answer[1] != data.RepSuccess {
+		return 0, answer[1]
+	}
+	size := socksReplyHeaderSize + 2
+	switch answer[3] {
+	case data.AtypIPv4:
+		size += 4
+	case data.AtypIPv6:
+		size += 16
+	case data.AtypDomain:
+		size += 1 + int(answer[4])
+	default:
+		return 0, data.RepGeneralFailure
+	}
+	if len(answer) < size {
+		return 0, data.RepSuccess
+	}
+	return size, data.RepSuccess
+}
+
+func socksRequest(ch *data.ChainHandshake) []byte {
+	request := []byte{data.SocksVer, data.SocksCmdConnect, 0x00}
+	ip := net.ParseIP(ch.Host)
+	switch {
+	case ip.To4() != nil:
+		request = append(request, data.AtypIPv4)
+		request = append(request, ip.To4()...)
+	case ip != nil:
+		request = append(request, data.AtypIPv6)
+		request = append(request, ip.To16()...)
+	default:
+		request = append(request, data.AtypDomain, byte(len(ch.Host)))
+		request = append(request, ch.Host...)
+	}
+	return binary.BigEndian.AppendUint16(request, uint16(ch.Port))
+}
+
+func readHTTPResponse(answer []byte) (int, byte) {
+	end := bytes.Index(answer, []byte("\r\n\r\n"))
+	if end < 0 {
+		if len(answer) >= maxHTTPResponseSize {
+			return 0, data.RepGeneralFailure
+		}
+		return 0, data.RepSuccess
+	}
+
+	// Status line: HTTP/1.1 200 Connection established
+	statusLine, _, _ := bytes.Cut(answer[:end], []byte("\r\n"))
+	fields := bytes.Fields(statusLine)
+	if len(fields) < 2 || !bytes.HasPrefix(fields[0], []byte("HTTP/")) {
+		return 0, data.RepGeneralFailure
+	}
+	status, err := strconv.Atoi(string(fields[1]))
+	if err != nil {
+		return 0, data.RepGeneralFailure
+	}
+	switch {
+	case status >= 200 && status < 300:
+		return end + 4, data.RepSuccess
+	case status == 403 || status == 407:
+		return 0, data.RepConnectionNotAllowed
+	case status == 502 || status == 503 || status == 504:
+		return 0, data.RepHostUnreachable
+	}
+	return 0, data.RepGeneralFailure
+}
+
+func fail(r *data.Reactor, conn *data.Conn, rep byte) {
+	utils.SendSocksReply(r, conn, rep, data.AtypIPv4, nil, 0)
+	utils.CloseConn(r, conn)
+}
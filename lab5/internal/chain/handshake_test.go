@@ -0,0 +1,182 @@
+package chain
+
+import (
+	"bytes"
+	"lab5/internal/data"
+	"net"
+	"strings"
+	"testing"
+)
+
+func socksReply(rep, atyp byte, addr ...byte) []byte {
+	reply := append([]byte{data.SocksVer, rep, 0x00, atyp}, addr...)
+	return append(reply, 0x1F, 0x90)
+}
+
+func TestReadSocksReply(t *testing.T) {
+	ipv4 := socksReply(data.RepSuccess, data.AtypIPv4, 192, 0, 2, 1)
+	ipv6 := socksReply(data.RepSuccess, data.AtypIPv6, net.ParseIP("2001:db8::1")...)
+	domain := socksReply(data.RepSuccess, data.AtypDomain, append([]byte{11}, "example.com"...)...)
+	tests := []struct {
+		name   string
+		answer []byte
+		used   int
+		rep    byte
+	}{
+		{name: "ipv4", answer: ipv4, used: 10},
+		{name: "ipv6", answer: ipv6, used: 22},
+		{name: "domain", answer: domain, used: 18},
+		{name: "relayed data after the reply", answer: append(append([]byte(nil), ipv4...), "data"...), used: 10},
+		{name: "partial header", answer: ipv4[:3]},
+		{name: "partial ipv4 address", answer: ipv4[:7]},
+		{name: "partial ipv6 address", answer: ipv6[:20]},
+		{name: "domain length only", answer: domain[:5]},
+		{name: "partial domain", answer: domain[:16]},
+		{name: "refused", answer: socksReply(data.RepConnectionRefused, data.AtypIPv4, 0, 0, 0, 0), rep: data.RepConnectionRefused},
+		{name: "not allowed", answer: socksReply(data.RepConnectionNotAllowed, data.AtypIPv4, 0, 0, 0, 0), rep: data.RepConnectionNotAllowed},
+		{name: "wrong version", answer: append([]byte{0x04}, ipv4[1:]...), rep: data.RepGeneralFailure},
+		{name: "unknown address type", answer: socksReply(data.RepSuccess, 0x05, 0, 0, 0, 0), rep: data.RepGeneralFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			used, rep := readSocksReply(&data.ChainHandshake{}, tt.answer)
+			if used != tt.used || rep != tt.rep {
+				t.Errorf("readSocksReply() = %d, %#x; want %d, %#x", used, rep, tt.used, tt.rep)
+			}
+		})
+	}
+}
+
+func TestReadSocksMethodAndAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		step     int
+		username string
+		answer   []byte
+		used     int
+		rep      byte
+		next     int
+	}{
+		{name: "no auth", step: stepSocksMethod, answer: []byte{data.SocksVer, data.SocksMethodNoAuth}, used: 2, next: stepSocksReply},
+		{name: "user pass", step: stepSocksMethod, username: "bob", answer: []byte{data.SocksVer, data.SocksMethodUserPass}, used: 2, next: stepSocksAuth},
+		{name: "partial method", step: stepSocksMethod, answer: []byte{data.SocksVer}, next: stepSocksMethod},
+		{name: "no acceptable method", step: stepSocksMethod, username: "bob", answer: []byte{data.SocksVer, data.SocksMethodNoAcceptable}, rep: data.RepGeneralFailure},
+		{name: "user pass without credentials", step: stepSocksMethod, answer: []byte{data.SocksVer, data.SocksMethodUserPass}, rep: data.RepGeneralFailure},
+		{name: "wrong version", step: stepSocksMethod, answer: []byte{0x04, data.SocksMethodNoAuth}, rep: data.RepGeneralFailure},
+		{name: "auth accepted", step: stepSocksAuth, username: "bob", answer: []byte{data.AuthVer, data.AuthStatusSuccess}, used: 2, next: stepSocksReply},
+		{name: "auth rejected", step: stepSocksAuth, username: "bob", answer: []byte{data.AuthVer, data.AuthStatusFailure}, rep: data.RepGeneralFailure},
+		{name: "partial auth", step: stepSocksAuth, username: "bob", answer: []byte{data.AuthVer}, next: stepSocksAuth},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := &data.ChainHandshake{Username: tt.username, Password: "pw", Host: "example.com", Port: 80, Step: tt.step}
+			var used int
+			var rep byte
+			if tt.step == stepSocksMethod {
+				used, rep = readSocksMethod(ch, tt.answer)
+			} else {
+				used, rep = readSocksAuth(ch, tt.answer)
+			}
+			if used != tt.used || rep != tt.rep {
+				t.Fatalf("used %d, rep %#x; want %d, %#x", used, rep, tt.used, tt.rep)
+			}
+			if rep == data.RepSuccess && ch.Step != tt.next {
+				t.Errorf("step %d; want %d", ch.Step, tt.next)
+			}
+		})
+	}
+}
+
+func TestSocksRequest(t *testing.T) {
+	tests := []struct {
+		host string
+		want []byte
+	}{
+		{"192.0.2.1", []byte{data.SocksVer, data.SocksCmdConnect, 0x00, data.AtypIPv4, 192, 0, 2, 1, 0x01, 0xBB}},
+		{"2001:db8::1", append(append([]byte{data.SocksVer, data.SocksCmdConnect, 0x00, data.AtypIPv6}, net.ParseIP("2001:db8::1")...), 0x01, 0xBB)},
+		{"example.com", append(append([]byte{data.SocksVer, data.SocksCmdConnect, 0x00, data.AtypDomain, 11}, "example.com"...), 0x01, 0xBB)},
+	}
+	for _, tt := range tests {
+		if got := socksRequest(&data.ChainHandshake{Host: tt.host, Port: 443}); !bytes.Equal(got, tt.want) {
+			t.Errorf("socksRequest(%s) = %v; want %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestReadHTTPResponse(t *testing.T) {
+	ok := "HTTP/1.1 200 Connection established\r\nVia: parent\r\n\r\n"
+	tests := []struct {
+		name   string
+		answer string
+		used   int
+		rep    byte
+	}{
+		{name: "established", answer: ok, used: len(ok)},
+		{name: "relayed data after the response", answer: ok + "data", used: len(ok)},
+		{name: "http/1.0 without headers", answer: "HTTP/1.0 200 OK\r\n\r\n", used: 19},
+		{name: "partial status line", answer: "HTTP/1.1 20"},
+		{name: "status line without the blank line", answer: "HTTP/1.1 200 OK\r\n"},
+		{name: "partial headers", answer: ok[:len(ok)-2]},
+		{name: "forbidden", answer: "HTTP/1.1 403 Forbidden\r\n\r\n", rep: data.RepConnectionNotAllowed},
+		{name: "auth required", answer: "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n", rep: data.RepConnectionNotAllowed},
+		{name: "bad gateway", answer: "HTTP/1.1 502 Bad Gateway\r\n\r\n", rep: data.RepHostUnreachable},
+		{name: "gateway timeout", answer: "HTTP/1.1 504 Gateway Timeout\r\n\r\n", rep: data.RepHostUnreachable},
+		{name: "other error", answer: "HTTP/1.1 500 Internal Server Error\r\n\r\n", rep: data.RepGeneralFailure},
+		{name: "not http", answer: "SSH-2.0 200\r\n\r\n", rep: data.RepGeneralFailure},
+		{name: "status not a number", answer: "HTTP/1.1 OK\r\n\r\n", rep: data.RepGeneralFailure},
+		{name: "headers too large", answer: "HTTP/1.1 200 OK\r\n" + strings.Repeat("X", maxHTTPResponseSize), rep: data.RepGeneralFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			used, rep := readHTTPResponse([]byte(tt.answer))
+			if used != tt.used || rep != tt.rep {
+				t.Errorf("readHTTPResponse() = %d, %#x; want %d, %#x", used, rep, tt.used, tt.rep)
+			}
+		})
+	}
+}
+
+func TestConsumeSplitReply(t *testing.T) {
+	relayed := []byte("relayed data")
+	tests := []struct {
+		name  string
+		ch    data.ChainHandshake
+		reply []byte
+	}{
+		{
+			name:  "socks reply",
+			ch:    data.ChainHandshake{Step: stepSocksReply},
+			reply: []byte{data.SocksVer, data.RepSuccess, 0x00, data.AtypIPv4, 192, 0, 2, 1, 0x1F, 0x90},
+		},
+		{
+			name:  "http response",
+			ch:    data.ChainHandshake{IsHTTP: true, Step: stepHTTPResponse},
+			reply: []byte("HTTP/1.1 200 Connection established\r\nVia: parent\r\n\r\n"),
+		},
+	}
+	for _, tt := range tests {
+		for size := 1; size < len(tt.reply); size++ {
+			ch := tt.ch
+			stream := append(append([]byte(nil), tt.reply...), relayed...)
+			var done bool
+			var rep byte
+			for off := 0; off < len(tt.reply); off += size {
+				if done {
+					t.Fatalf("%s in %d byte reads: reply complete after %d bytes", tt.name, size, off)
+				}
+				end := min(off+size, len(tt.reply))
+				if end == len(tt.reply) {
+					end = len(stream)
+				}
+				ch.In = append(ch.In, stream[off:end]...)
+				done, rep = consume(&ch)
+				if rep != data.RepSuccess {
+					t.Fatalf("%s in %d byte reads: rep %#x", tt.name, size, rep)
+				}
+			}
+			if !done || !bytes.Equal(ch.In, relayed) {
+				t.Errorf("%s in %d byte reads: done %v, rest %q", tt.name, size, done, ch.In)
+			}
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package chain
+
+import (
+	"bufio"
+	"fmt"
+	"lab5/internal/acl"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Proxy is a parent proxy that connections are chained through.
+type Proxy struct {
+	IsHTTP   bool
+	IP       net.IP
+	Port     int
+	Username string
+	Password string
+}
+
+type route struct {
+	dest  acl.Destination
+	proxy *Proxy // nil means connect directly
+}
+
+type Routes struct {
+	routes []route
+}
+
+// routes is nil when chaining is off; it is shared by all reactors and replaced on reload.
+var routes atomic.Pointer[Routes]
+
+func SetRoutes(rs *Routes) {
+	routes.Store(rs)
+}
+
+func (rs *Routes) Len() int {
+	return len(rs.routes)
+}
+
+// Load reads lines of the form "<destination> <via>", where destination is a CIDR, IP, domain
+// glob or "*", and via is "direct", "socks5://[user:pass@]host:port" or
+// "http://[user:pass@]host:port". Parent host names are resolved once, here.
+func Load(filePath string) (*Routes, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+
+	rs := &Routes{}
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected: <destination> <via>", filePath, lineNum)
+		}
+		dest, err := acl.ParseDestination(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: destination: %v", filePath, lineNum, err)
+		}
+		proxy, err := parseProxy(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filePath, lineNum, err)
+		}
+		rs.routes = append(rs.routes, route{dest: dest, proxy: proxy})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+func parseProxy(s string) (*Proxy, error) {
+	if s == "direct" {
+		return nil, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	proxy := &Proxy{}
+	switch u.Scheme {
+	case "socks5":
+	case "http":
+		proxy.IsHTTP = true
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Port() == "" {
+		return nil, fmt.Errorf("proxy %q has no port", s)
+	}
+	addr, err := net.ResolveTCPAddr("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	proxy.IP, proxy.Port = addr.IP, addr.Port
+	if u.User != nil {
+		proxy.Username = u.User.Username()
+		proxy.Password, _ = u.User.Password()
+	}
+	return proxy, nil
+}
+
+// Route returns the parent proxy for a destination or nil for a direct connection. Domains are
+// routed before they are resolved, so the parent proxy resolves them; network rules only apply
+// to requests for an address.
+func Route(domain string, ip net.IP) *Proxy {
+	rs := routes.Load()
+	if rs == nil {
+		return nil
+	}
+	for _, r := range rs.routes {
+		if r.dest.Match(domain, ip) {
+			return r.proxy
+		}
+	}
+	return nil
+}
@@ -8,8 +8,9 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-func FlushClientWrites(conn *data.Conn) {
-	for conn.UpstreamToClientBuffer.Len() > 0 {
+func FlushClientWrites(r *data.Reactor, conn *data.Conn) {
+	writable := !conn.EdgeTriggered || conn.ClientWritable
+	for writable && conn.UpstreamToClientBuffer.Len() > 0 {
 		bytes := conn.UpstreamToClientBuffer.Bytes()
 		if len(bytes) == 0 {
 			break
@@ -20,15 +21,28 @@ func FlushClientWrites(conn *data.Conn) {
 		}
 		if err != nil {
 			if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EWOULDBLOCK) {
-				_ = utils.EpollMod(conn.ClientFD, unix.EPOLLIN|unix.EPOLLOUT)
-				return
+				writable = false
+				break
 			}
-			utils.CloseConn(conn)
+			utils.CloseConn(r, conn)
 			return
 		}
 	}
-	_ = utils.EpollMod(conn.ClientFD, unix.EPOLLIN)
-	if conn.UpstreamClosed && conn.UpstreamToClientBuffer.Len() == 0 {
+	if writable && conn.UpstreamToClientBuffer.Len() == 0 && conn.UpstreamToClientPipe != nil {
+		if err := utils.DrainPipe(conn.UpstreamToClientPipe, conn.ClientFD); err != nil {
+			utils.CloseConn(r, conn)
+			return
+		}
+		writable = utils.PipePending(conn.UpstreamToClientPipe) == 0
+	}
+	if conn.EdgeTriggered {
+		conn.ClientWritable = writable
+	}
+	utils.UpdateClientEvents(r, conn)
+	if conn.UpstreamReadPaused {
+		utils.UpdateUpstreamEvents(r, conn)
+	}
+	if conn.UpstreamClosed && conn.UpstreamToClientBuffer.Len() == 0 && utils.PipePending(conn.UpstreamToClientPipe) == 0 {
 		_ = unix.Shutdown(conn.ClientFD, unix.SHUT_WR)
 	}
 }
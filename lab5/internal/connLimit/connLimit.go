@@ -0,0 +1,49 @@
+package connLimit
+
+import (
+	"net"
+	"sync"
+)
+
+// MaxTotal and MaxPerIP bound the client connections of all reactors together; 0 means no limit.
+var (
+	MaxTotal int
+	MaxPerIP int
+)
+
+var (
+	mu    sync.Mutex
+	total int
+	perIP = make(map[string]int)
+)
+
+func Enabled() bool {
+	return MaxTotal > 0 || MaxPerIP > 0
+}
+
+// Acquire counts a new connection from ip. When a limit is already reached it counts nothing and
+// returns false.
+func Acquire(ip net.IP) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	if MaxTotal > 0 && total >= MaxTotal {
+		return false
+	}
+	key := ip.String()
+	if MaxPerIP > 0 && perIP[key] >= MaxPerIP {
+		return false
+	}
+	total++
+	perIP[key]++
+	return true
+}
+
+func Release(ip net.IP) {
+	mu.Lock()
+	defer mu.Unlock()
+	key := ip.String()
+	total--
+	if perIP[key]--; perIP[key] <= 0 {
+		delete(perIP, key)
+	}
+}
@@ -3,42 +3,142 @@ package connect
 import (
 	"errors"
 	"fmt"
+	"lab5/internal/acl"
+	"lab5/internal/bufferPool"
+	"lab5/internal/connLimit"
 	"lab5/internal/data"
 	"lab5/internal/handlerWrite"
+	"lab5/internal/rateLimit"
+	"lab5/internal/upStream"
 	"lab5/internal/utils"
 	"log"
 	"net"
+	"slices"
+	"strconv"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
 
-func AcceptLoop(ln int) {
+// acceptPause is how long a listener is left alone after an accept error it cannot work around.
+const acceptPause = 100 * time.Millisecond
+
+func AcceptLoop(r *data.Reactor, listenFD int) {
 	for {
-		nfd, _, err := unix.Accept4(ln, unix.SOCK_NONBLOCK)
+		nfd, sa, err := unix.Accept4(listenFD, unix.SOCK_NONBLOCK)
 		if err != nil {
 			if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EWOULDBLOCK) {
 				return
 			}
+			if errors.Is(err, unix.EINTR) || errors.Is(err, unix.ECONNABORTED) {
+				continue
+			}
+			if (errors.Is(err, unix.EMFILE) || errors.Is(err, unix.ENFILE)) && r.ReserveFD >= 0 {
+				if !shedWithReserve(r, listenFD) {
+					return
+				}
+				r.Stats.Accepted++
+				r.Stats.Refused++
+				continue
+			}
 			fmt.Printf("accept error: %v\n", err)
+			pauseAccept(r, listenFD)
 			return
 		}
-		conn := &data.Conn{ClientFD: nfd, UpstreamFD: -1, State: data.StateGreeting}
-		data.Conns[nfd] = conn
-		data.FdsInfo[nfd] = &data.FDInfo{Conn: conn, IsClient: true}
-		if err = utils.EpollAdd(nfd, unix.EPOLLIN); err != nil {
+		r.Stats.Accepted++
+		ip, port := clientAddr(sa)
+		// Refused connections are closed at once: waiting for a first message to answer it in the
+		// client's protocol would let a flooding client hold descriptors past its limit.
+		if r.Pool.Exhausted() || connLimit.Enabled() && !connLimit.Acquire(ip) {
+			r.Stats.Refused++
+			err = unix.Close(nfd)
+			if err != nil {
+				log.Printf("close(%d) faile: %v", nfd, err)
+			}
+			continue
+		}
+		conn := &data.Conn{
+			ClientFD:               nfd,
+			ClientIP:               ip,
+			ClientPort:             port,
+			UpstreamFD:             -1,
+			UDPRelayFD:             -1,
+			State:                  data.StateGreeting,
+			Counted:                connLimit.Enabled(),
+			AcceptedAt:             time.Now(),
+			ClientToUpstreamBuffer: bufferPool.NewQueue(r.Pool),
+			UpstreamToClientBuffer: bufferPool.NewQueue(r.Pool),
+		}
+		r.Conns[nfd] = conn
+		r.FdsInfo[nfd] = &data.FDInfo{Conn: conn, IsClient: true}
+		if err = utils.EpollAdd(r, nfd, unix.EPOLLIN); err != nil {
 			fmt.Printf("epoll add client: %v\n", err)
 			err = unix.Close(nfd)
 			if err != nil {
 				log.Printf("close(%d) faile: %v", nfd, err)
 			}
-			delete(data.Conns, nfd)
-			delete(data.FdsInfo, nfd)
+			if conn.Counted {
+				connLimit.Release(ip)
+			}
+			delete(r.Conns, nfd)
+			delete(r.FdsInfo, nfd)
 			continue
 		}
+		utils.ArmDeadline(r, conn)
+	}
+}
+
+// shedWithReserve handles EMFILE/ENFILE: the reserve descriptor is given up for a moment to accept
+// and close one pending connection, so the level-triggered listener does not spin on it. It
+// returns false once nothing is pending.
+func shedWithReserve(r *data.Reactor, listenFD int) bool {
+	if err := unix.Close(r.ReserveFD); err != nil {
+		log.Printf("close(%d) faile: %v", r.ReserveFD, err)
+	}
+	nfd, _, err := unix.Accept4(listenFD, unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC)
+	if err == nil {
+		if closeErr := unix.Close(nfd); closeErr != nil {
+			log.Printf("close(%d) faile: %v", nfd, closeErr)
+		}
+	}
+	reopenReserve(r)
+	return err == nil
+}
+
+// reopenReserve leaves ReserveFD at -1 when another thread took the freed descriptor first.
+func reopenReserve(r *data.Reactor) {
+	fd, err := unix.Open("/dev/null", unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		r.ReserveFD = -1
+		return
+	}
+	r.ReserveFD = fd
+}
+
+// OpenReserve sets aside the descriptor shedWithReserve frees when the process runs out of them.
+func OpenReserve(r *data.Reactor) error {
+	reopenReserve(r)
+	if r.ReserveFD < 0 {
+		return errors.New("open reserve descriptor faile")
 	}
+	return nil
+}
+
+// pauseAccept stops polling the listener for acceptPause; it is polled again unless it was closed
+// for shutdown in the meantime.
+func pauseAccept(r *data.Reactor, listenFD int) {
+	_ = utils.EpollMod(r, listenFD, 0)
+	r.Timers.Add(acceptPause, func() {
+		if r.ReserveFD < 0 {
+			reopenReserve(r)
+		}
+		if slices.Contains(r.ListenFDs, listenFD) {
+			_ = utils.EpollMod(r, listenFD, unix.EPOLLIN)
+		}
+	})
 }
 
-func StartUpstreamConnect(conn *data.Conn, addr string, port int, isIPv6 bool) bool {
+func StartUpstreamConnect(r *data.Reactor, conn *data.Conn, addr string, port int, isIPv6 bool) bool {
 	var upstreamFd int
 	var err error
 
@@ -49,38 +149,32 @@ func StartUpstreamConnect(conn *data.Conn, addr string, port int, isIPv6 bool) b
 	}
 
 	if err != nil {
-		var atyp byte
-		if isIPv6 {
-			atyp = data.AtypIPv6
-		} else {
-			atyp = data.AtypIPv4
-		}
-		utils.SendSocksReply(conn, data.RepGeneralFailure, atyp, nil, 0)
+		utils.SendSocksReply(r, conn, utils.ReplyForError(err), data.AtypIPv4, nil, 0)
 		return false
 	}
 
 	conn.UpstreamFD = upstreamFd
-	data.FdsInfo[upstreamFd] = &data.FDInfo{Conn: conn, IsClient: false}
+	r.FdsInfo[upstreamFd] = &data.FDInfo{Conn: conn, IsClient: false}
 
 	if err = unix.SetNonblock(upstreamFd, true); err != nil {
 		err = unix.Close(upstreamFd)
 		if err != nil {
 			log.Printf("close(%d) faile: %v", upstreamFd, err)
 		}
-		delete(data.FdsInfo, upstreamFd)
+		delete(r.FdsInfo, upstreamFd)
 		conn.UpstreamFD = -1
-		utils.SendSocksReply(conn, data.RepGeneralFailure, data.AtypIPv4, nil, 0)
+		utils.SendSocksReply(r, conn, data.RepGeneralFailure, data.AtypIPv4, nil, 0)
 		return false
 	}
 
-	if err = utils.EpollAdd(upstreamFd, unix.EPOLLOUT); err != nil {
+	if err = utils.EpollAdd(r, upstreamFd, unix.EPOLLOUT); err != nil {
 		err = unix.Close(upstreamFd)
 		if err != nil {
 			log.Printf("close(%d) faile: %v", upstreamFd, err)
 		}
-		delete(data.FdsInfo, upstreamFd)
+		delete(r.FdsInfo, upstreamFd)
 		conn.UpstreamFD = -1
-		utils.SendSocksReply(conn, data.RepGeneralFailure, data.AtypIPv4, nil, 0)
+		utils.SendSocksReply(r, conn, data.RepGeneralFailure, data.AtypIPv4, nil, 0)
 		return false
 	}
 
@@ -92,12 +186,12 @@ func StartUpstreamConnect(conn *data.Conn, addr string, port int, isIPv6 bool) b
 	}
 
 	if ipAddr == nil {
-		utils.EpollDel(upstreamFd)
+		utils.EpollDel(r, upstreamFd)
 		err = unix.Close(upstreamFd)
 		if err != nil {
 			log.Printf("close(%d) faile: %v", upstreamFd, err)
 		}
-		delete(data.FdsInfo, upstreamFd)
+		delete(r.FdsInfo, upstreamFd)
 		conn.UpstreamFD = -1
 		var atyp byte
 		if isIPv6 {
@@ -105,7 +199,7 @@ func StartUpstreamConnect(conn *data.Conn, addr string, port int, isIPv6 bool) b
 		} else {
 			atyp = data.AtypIPv4
 		}
-		utils.SendSocksReply(conn, data.RepGeneralFailure, atyp, nil, 0)
+		utils.SendSocksReply(r, conn, data.RepGeneralFailure, atyp, nil, 0)
 		return false
 	}
 
@@ -128,22 +222,129 @@ func StartUpstreamConnect(conn *data.Conn, addr string, port int, isIPv6 bool) b
 		if errors.Is(err, unix.EINPROGRESS) || errors.Is(err, unix.EALREADY) {
 			return true
 		}
-		utils.EpollDel(upstreamFd)
+		rep := utils.ReplyForError(err)
+		utils.EpollDel(r, upstreamFd)
 		err = unix.Close(upstreamFd)
 		if err != nil {
 			log.Printf("close(%d) faile: %v", upstreamFd, err)
 		}
-		delete(data.FdsInfo, upstreamFd)
+		delete(r.FdsInfo, upstreamFd)
 		conn.UpstreamFD = -1
-		var atyp byte
-		if isIPv6 {
-			atyp = data.AtypIPv6
-		} else {
-			atyp = data.AtypIPv4
-		}
-		utils.SendSocksReply(conn, data.RepGeneralFailure, atyp, nil, 0)
+		utils.SendSocksReply(r, conn, rep, data.AtypIPv4, nil, 0)
 		return false
 	}
-	handlerWrite.Upstream(conn)
+	handlerWrite.Upstream(r, conn)
 	return true
 }
+
+func StartBind(r *data.Reactor, conn *data.Conn, host string) bool {
+	localSa, err := unix.Getsockname(conn.ClientFD)
+	if err != nil {
+		utils.SendSocksReply(r, conn, data.RepGeneralFailure, data.AtypIPv4, nil, 0)
+		return false
+	}
+	localIP, _ := utils.SockaddrToIP(localSa)
+	isIPv6 := localIP.To4() == nil
+
+	var listenFd int
+	if isIPv6 {
+		listenFd, err = unix.Socket(unix.AF_INET6, unix.SOCK_STREAM, 0)
+	} else {
+		listenFd, err = unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
+	}
+	if err != nil {
+		utils.SendSocksReply(r, conn, data.RepGeneralFailure, data.AtypIPv4, nil, 0)
+		return false
+	}
+
+	conn.UpstreamFD = listenFd
+	r.FdsInfo[listenFd] = &data.FDInfo{Conn: conn, IsClient: false}
+
+	if isIPv6 {
+		_ = unix.SetsockoptInt(listenFd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, 0)
+	}
+	if err = unix.SetNonblock(listenFd, true); err != nil {
+		utils.SendSocksReply(r, conn, data.RepGeneralFailure, data.AtypIPv4, nil, 0)
+		return false
+	}
+	if err = unix.Bind(listenFd, utils.IPToSockaddr(localIP, 0, isIPv6)); err != nil {
+		utils.SendSocksReply(r, conn, data.RepGeneralFailure, data.AtypIPv4, nil, 0)
+		return false
+	}
+	if err = unix.Listen(listenFd, 1); err != nil {
+		utils.SendSocksReply(r, conn, data.RepGeneralFailure, data.AtypIPv4, nil, 0)
+		return false
+	}
+	boundSa, err := unix.Getsockname(listenFd)
+	if err != nil {
+		utils.SendSocksReply(r, conn, data.RepGeneralFailure, data.AtypIPv4, nil, 0)
+		return false
+	}
+	if err = utils.EpollAdd(r, listenFd, unix.EPOLLIN); err != nil {
+		utils.SendSocksReply(r, conn, data.RepGeneralFailure, data.AtypIPv4, nil, 0)
+		return false
+	}
+
+	if expectedIP := net.ParseIP(host); expectedIP != nil && !expectedIP.IsUnspecified() {
+		conn.BindExpectedIP = expectedIP
+	}
+
+	boundIP, boundPort := utils.SockaddrToIP(boundSa)
+	return utils.SendAddrReply(r, conn, boundIP, boundPort)
+}
+
+func AcceptBind(r *data.Reactor, conn *data.Conn) {
+	listenFd := conn.UpstreamFD
+	peerFd, peerSa, err := unix.Accept4(listenFd, unix.SOCK_NONBLOCK)
+	if err != nil {
+		if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EWOULDBLOCK) {
+			return
+		}
+		utils.SendSocksReply(r, conn, data.RepGeneralFailure, data.AtypIPv4, nil, 0)
+		utils.CloseConn(r, conn)
+		return
+	}
+
+	utils.EpollDel(r, listenFd)
+	err = unix.Close(listenFd)
+	if err != nil {
+		log.Printf("close(%d) faile: %v", listenFd, err)
+	}
+	delete(r.FdsInfo, listenFd)
+
+	conn.UpstreamFD = peerFd
+	r.FdsInfo[peerFd] = &data.FDInfo{Conn: conn, IsClient: false}
+
+	peerIP, peerPort := utils.SockaddrToIP(peerSa)
+	if conn.BindExpectedIP != nil && !conn.BindExpectedIP.Equal(peerIP) || !acl.Allowed(conn.ClientIP, "", peerIP, peerPort) {
+		utils.SendSocksReply(r, conn, data.RepConnectionNotAllowed, data.AtypIPv4, nil, 0)
+		utils.CloseConn(r, conn)
+		return
+	}
+	if err = utils.EpollAdd(r, peerFd, unix.EPOLLIN); err != nil {
+		utils.SendSocksReply(r, conn, data.RepGeneralFailure, data.AtypIPv4, nil, 0)
+		utils.CloseConn(r, conn)
+		return
+	}
+	if !utils.SendAddrReply(r, conn, peerIP, peerPort) {
+		utils.CloseConn(r, conn)
+		return
+	}
+	conn.Upstream = net.JoinHostPort(peerIP.String(), strconv.Itoa(peerPort))
+	conn.ConnectedAt = time.Now()
+	conn.Limits = rateLimit.ForConn(conn.ClientIP, conn.Username)
+
+	conn.State = data.StateRelaying
+	utils.StartSplice(conn)
+	utils.StartEdgeTriggered(r, conn)
+	utils.ArmDeadline(r, conn)
+	upStream.FlushUpstreamWrites(r, conn)
+}
+
+func clientAddr(sa unix.Sockaddr) (net.IP, int) {
+	ip, port := utils.SockaddrToIP(sa)
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4, port
+	}
+	return ip, port
+}
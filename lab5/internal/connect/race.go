@@ -0,0 +1,209 @@
+package connect
+
+import (
+	"errors"
+	"lab5/internal/acl"
+	"lab5/internal/data"
+	"lab5/internal/handlerWrite"
+	"lab5/internal/utils"
+	"log"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	resolutionDelay        = 50 * time.Millisecond
+	connectionAttemptDelay = 250 * time.Millisecond
+)
+
+// AddRaceAddresses is called once per DNS answer (A or AAAA); ips is empty when the query failed.
+func AddRaceAddresses(r *data.Reactor, conn *data.Conn, ips []net.IP, isIPv6 bool) {
+	race := conn.Race
+	if race == nil || conn.ClientFD < 0 {
+		return
+	}
+	race.PendingAnswers--
+	ips = allowedAddresses(conn, ips)
+	if isIPv6 {
+		race.IPv6Addrs = append(race.IPv6Addrs, ips...)
+	} else {
+		race.IPv4Addrs = append(race.IPv4Addrs, ips...)
+	}
+
+	if race.Started {
+		if race.Timer == nil {
+			startNextAttempt(r, conn)
+		}
+		return
+	}
+	if isIPv6 || race.PendingAnswers == 0 {
+		startRace(r, conn)
+		return
+	}
+	if len(ips) > 0 && race.Timer == nil {
+		race.Timer = r.Timers.Add(resolutionDelay, func() {
+			race.Timer = nil
+			startRace(r, conn)
+		})
+	}
+}
+
+func startRace(r *data.Reactor, conn *data.Conn) {
+	race := conn.Race
+	if race == nil || race.Started {
+		return
+	}
+	r.Timers.Stop(race.Timer)
+	race.Timer = nil
+	race.Started = true
+	conn.ResolvedAt = time.Now()
+	conn.State = data.StateConnecting
+	startNextAttempt(r, conn)
+}
+
+func startNextAttempt(r *data.Reactor, conn *data.Conn) {
+	race := conn.Race
+	r.Timers.Stop(race.Timer)
+	race.Timer = nil
+
+	for {
+		ip := nextRaceAddress(race)
+		if ip == nil {
+			break
+		}
+		race.Tried++
+		fd, err := dialNonblock(ip, race.Port)
+		if err != nil {
+			race.LastErr = err
+			continue
+		}
+		r.FdsInfo[fd] = &data.FDInfo{Conn: conn, IsConnectAttempt: true}
+		if err = utils.EpollAdd(r, fd, unix.EPOLLOUT); err != nil {
+			closeAttempt(r, fd)
+			continue
+		}
+		race.Attempts = append(race.Attempts, fd)
+		race.Timer = r.Timers.Add(connectionAttemptDelay, func() {
+			race.Timer = nil
+			startNextAttempt(r, conn)
+		})
+		return
+	}
+
+	if len(race.Attempts) == 0 && race.PendingAnswers == 0 {
+		rep := utils.ReplyForError(race.LastErr)
+		if race.Tried == 0 && race.Denied {
+			rep = data.RepConnectionNotAllowed
+		} else if race.Tried == 0 {
+			rep = data.RepHostUnreachable
+		}
+		utils.SendSocksReply(r, conn, rep, data.AtypIPv4, nil, 0)
+		utils.CloseConn(r, conn)
+	}
+}
+
+// HandleAttempt processes readiness of one in-flight connection attempt; the first one to
+// connect becomes the upstream and every other attempt is abandoned.
+func HandleAttempt(r *data.Reactor, conn *data.Conn, fd int, events uint32) {
+	race := conn.Race
+	if race == nil {
+		closeAttempt(r, fd)
+		return
+	}
+
+	soErr, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
+	if err != nil || soErr != 0 || events&(unix.EPOLLERR|unix.EPOLLHUP) != 0 {
+		if soErr != 0 {
+			race.LastErr = unix.Errno(soErr)
+		}
+		removeAttempt(race, fd)
+		closeAttempt(r, fd)
+		startNextAttempt(r, conn)
+		return
+	}
+	if events&unix.EPOLLOUT == 0 {
+		return
+	}
+
+	removeAttempt(race, fd)
+	for _, other := range race.Attempts {
+		closeAttempt(r, other)
+	}
+	r.Timers.Stop(race.Timer)
+	conn.Race = nil
+
+	conn.UpstreamFD = fd
+	r.FdsInfo[fd].IsConnectAttempt = false
+	handlerWrite.Upstream(r, conn)
+}
+
+// allowedAddresses drops resolved addresses that the access rules forbid for this client.
+func allowedAddresses(conn *data.Conn, ips []net.IP) []net.IP {
+	race := conn.Race
+	allowed := ips[:0:0]
+	for _, ip := range ips {
+		if acl.Allowed(conn.ClientIP, race.Domain, ip, race.Port) {
+			allowed = append(allowed, ip)
+		} else {
+			race.Denied = true
+		}
+	}
+	return allowed
+}
+
+// nextRaceAddress interleaves address families starting with IPv6, as RFC 8305 section 4 suggests.
+func nextRaceAddress(race *data.ConnectRace) net.IP {
+	var ip net.IP
+	if race.NextIsIPv6 && len(race.IPv6Addrs) > 0 || len(race.IPv4Addrs) == 0 && len(race.IPv6Addrs) > 0 {
+		ip, race.IPv6Addrs = race.IPv6Addrs[0], race.IPv6Addrs[1:]
+		race.NextIsIPv6 = false
+	} else if len(race.IPv4Addrs) > 0 {
+		ip, race.IPv4Addrs = race.IPv4Addrs[0], race.IPv4Addrs[1:]
+		race.NextIsIPv6 = true
+	}
+	return ip
+}
+
+func dialNonblock(ip net.IP, port int) (int, error) {
+	isIPv6 := ip.To4() == nil
+	var fd int
+	var err error
+	if isIPv6 {
+		fd, err = unix.Socket(unix.AF_INET6, unix.SOCK_STREAM, 0)
+	} else {
+		fd, err = unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
+	}
+	if err != nil {
+		return -1, err
+	}
+	if err = unix.SetNonblock(fd, true); err != nil {
+		_ = unix.Close(fd)
+		return -1, err
+	}
+	err = unix.Connect(fd, utils.IPToSockaddr(ip, port, isIPv6))
+	if err != nil && !errors.Is(err, unix.EINPROGRESS) {
+		_ = unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+func removeAttempt(race *data.ConnectRace, fd int) {
+	for i, attempt := range race.Attempts {
+		if attempt == fd {
+			race.Attempts = append(race.Attempts[:i], race.Attempts[i+1:]...)
+			return
+		}
+	}
+}
+
+func closeAttempt(r *data.Reactor, fd int) {
+	utils.EpollDel(r, fd)
+	err := unix.Close(fd)
+	if err != nil {
+		log.Printf("close(%d) faile: %v", fd, err)
+	}
+	delete(r.FdsInfo, fd)
+}
@@ -2,153 +2,426 @@ package controller
 
 import (
 	"errors"
+	"flag"
 	"fmt"
+	"lab5/internal/accessLog"
+	"lab5/internal/acl"
+	"lab5/internal/auth"
+	"lab5/internal/bufferPool"
+	"lab5/internal/chain"
+	"lab5/internal/connLimit"
 	"lab5/internal/connect"
 	"lab5/internal/data"
 	"lab5/internal/dns"
 	"lab5/internal/handlerRead"
 	"lab5/internal/handlerWrite"
+	"lab5/internal/metrics"
+	"lab5/internal/rateLimit"
+	"lab5/internal/timer"
+	"lab5/internal/udpRelay"
 	"lab5/internal/utils"
 	"log"
 	"os"
+	"os/signal"
+	"runtime"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
 
+var (
+	aclFile       = flag.String("acl", "", "access rules file (allow|deny <client> <destination> <ports>), reloaded on SIGHUP")
+	chainFile     = flag.String("chain", "", "routes file (<destination> direct|socks5://host:port|http://host:port), reloaded on SIGHUP")
+	limitsFile    = flag.String("limits", "", "rate limits file (global|user|client <who> <bytes/s>), reloaded on SIGHUP")
+	authFile      = flag.String("auth", "", "htpasswd file with bcrypt hashes; enables username/password authentication")
+	dnsServers    = flag.String("dns", "", "comma-separated DNS resolvers (ip, ip:port, [ipv6]:port); default is nameservers from /etc/resolv.conf")
+	dnsTimeout    = flag.Duration("dns-timeout", dns.QueryTimeout, "time to wait for a DNS answer before retransmitting")
+	dnsRetries    = flag.Int("dns-retries", dns.QueryRetries, "DNS retransmissions before the client gets 'host unreachable'")
+	dnsCacheSize  = flag.Int("dns-cache-size", dns.CacheSize, "maximum number of cached DNS answers; 0 disables the cache")
+	handshakeTime = flag.Duration("handshake-timeout", utils.HandshakeTimeout, "time a client has to finish the SOCKS handshake; 0 disables")
+	connectTime   = flag.Duration("connect-timeout", utils.ConnectTimeout, "time to resolve and connect to the destination (or wait for the BIND peer); 0 disables")
+	idleTime      = flag.Duration("idle-timeout", utils.IdleTimeout, "close relayed connections after this long without traffic; 0 disables")
+	edgeTrigger   = flag.Bool("edge-triggered", false, "register relayed sockets once with EPOLLET and track their readiness instead of re-arming level-triggered epoll")
+	spliceRelay   = flag.Bool("splice", false, "relay established connections with splice(2) through pipes instead of user-space buffers")
+	maxConns      = flag.Int("max-conns", 0, "maximum number of client connections; connections above it are closed right after accept, 0 means no limit")
+	maxConnsPerIP = flag.Int("max-conns-per-ip", 0, "maximum number of connections from one client IP; connections above it are closed right after accept, 0 means no limit")
+	memBudget     = flag.Int("mem-budget", 0, "MiB of relay buffers shared by all reactors; new connections are refused while it is used up, 0 means no limit")
+	listenAddrs   = flag.String("listen", "0.0.0.0", "comma-separated listen addresses (ip, ip:port, [ipv6]:port); entries without a port use <port>")
+	ipv6Only      = flag.Bool("ipv6only", false, "set IPV6_V6ONLY on IPv6 listeners so [::] does not also accept IPv4 clients")
+	shutdownGrace = flag.Duration("shutdown-grace", 30*time.Second, "on SIGTERM/SIGINT, time relayed connections get to finish before they are closed")
+	adminAddr     = flag.String("admin", "", "address of the admin HTTP listener with /metrics and /connections, e.g. 127.0.0.1:9090")
+	accessLogPath = flag.String("access-log", "", "write one JSON line per closed connection to this file, or to stdout for \"-\"")
+	accessLogSize = flag.Int("access-log-max-size", 100, "MiB after which the access log file is rotated; 0 disables rotation")
+	accessLogKeep = flag.Int("access-log-backups", 5, "number of rotated access log files to keep")
+	reactorsCount = flag.Int("reactors", 1, "number of epoll reactors, each on its own thread with a SO_REUSEPORT listener; 0 means one per CPU")
+)
+
 func Controller() {
-	if len(os.Args) != 2 {
-		fmt.Println("Usage: go run ./main.go <port>")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Println("Usage: go run ./main.go [-auth htpasswd] [-acl rules] [-chain routes] [-limits file] [-dns servers] [-dns-timeout 2s] [-dns-retries 2] [-dns-cache-size 1024] [-handshake-timeout 10s] [-connect-timeout 30s] [-idle-timeout 5m] [-splice] [-edge-triggered] [-max-conns N] [-max-conns-per-ip N] [-mem-budget MiB] [-listen addrs] [-ipv6only] [-shutdown-grace 30s] [-admin addr] [-access-log path|-] [-access-log-max-size MiB] [-access-log-backups 5] [-reactors N] <port>")
 		os.Exit(1)
 	}
-	port, err := strconv.Atoi(os.Args[1])
+	port, err := strconv.Atoi(flag.Arg(0))
 	if err != nil {
 		fmt.Printf("invalid port: %v\n", err)
 		os.Exit(1)
 	}
-
-	lnFD, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
+	listenSockaddrs, err := parseListenAddrs(*listenAddrs, port, *ipv6Only)
 	if err != nil {
-		fmt.Printf("socket faile: %v\n", err)
+		fmt.Printf("%v\n", err)
 		os.Exit(1)
 	}
-	defer func(fd int) {
-		err := unix.Close(fd)
+
+	if *authFile != "" {
+		store, err := auth.LoadHtpasswd(*authFile)
 		if err != nil {
-			log.Printf("close(%d) faile: %v", fd, err)
+			fmt.Printf("load auth file faile: %v\n", err)
+			os.Exit(1)
 		}
-	}(lnFD)
+		auth.Store = store
+		auth.StartWorkers()
+	}
 
-	_ = unix.SetsockoptInt(lnFD, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
-	if err := unix.SetNonblock(lnFD, true); err != nil {
-		fmt.Printf("setnonblock faile: %v\n", err)
+	if *aclFile != "" {
+		rules, err := acl.Load(*aclFile)
+		if err != nil {
+			fmt.Printf("load acl file faile: %v\n", err)
+			os.Exit(1)
+		}
+		acl.SetRules(rules)
+	}
+	if *chainFile != "" {
+		routes, err := chain.Load(*chainFile)
+		if err != nil {
+			fmt.Printf("load chain file faile: %v\n", err)
+			os.Exit(1)
+		}
+		chain.SetRoutes(routes)
+	}
+	if *limitsFile != "" {
+		limits, err := rateLimit.Load(*limitsFile)
+		if err != nil {
+			fmt.Printf("load limits file faile: %v\n", err)
+			os.Exit(1)
+		}
+		rateLimit.SetLimits(limits)
+	}
+
+	if *dnsTimeout <= 0 || *dnsRetries < 0 {
+		fmt.Println("dns-timeout must be positive and dns-retries non-negative")
 		os.Exit(1)
 	}
-	sa := &unix.SockaddrInet4{Port: port}
-	copy(sa.Addr[:], []byte{0, 0, 0, 0})
-	if err := unix.Bind(lnFD, sa); err != nil {
-		fmt.Printf("bind faile: %v\n", err)
+	dns.QueryTimeout = *dnsTimeout
+	dns.QueryRetries = *dnsRetries
+	dns.CacheSize = *dnsCacheSize
+	if err := dns.ConfigureResolvers(*dnsServers); err != nil {
+		fmt.Printf("dns resolvers: %v\n", err)
 		os.Exit(1)
 	}
-	if err := unix.Listen(lnFD, data.MaxLenQueueListen); err != nil {
-		fmt.Printf("listen faile: %v\n", err)
+	fmt.Printf("dns resolvers: %s\n", strings.Join(dns.Resolvers(), ", "))
+
+	if *handshakeTime < 0 || *connectTime < 0 || *idleTime < 0 {
+		fmt.Println("timeouts must not be negative")
 		os.Exit(1)
 	}
-	fmt.Printf("listening on :%d\n", port)
+	utils.HandshakeTimeout = *handshakeTime
+	utils.ConnectTimeout = *connectTime
+	utils.IdleTimeout = *idleTime
+	utils.SpliceEnabled = *spliceRelay
+	utils.EdgeTriggered = *edgeTrigger
 
-	data.Epfd, err = unix.EpollCreate1(0)
-	if err != nil {
-		fmt.Printf("epoll_create1 faile: %v\n", err)
+	reactorsNum := *reactorsCount
+	if reactorsNum <= 0 {
+		reactorsNum = runtime.NumCPU()
+	}
+	if *maxConns < 0 || *maxConnsPerIP < 0 {
+		fmt.Println("max-conns and max-conns-per-ip must not be negative")
 		os.Exit(1)
 	}
-	defer func(fd int) {
-		err := unix.Close(fd)
+	connLimit.MaxTotal = *maxConns
+	connLimit.MaxPerIP = *maxConnsPerIP
+	if *memBudget < 0 {
+		fmt.Println("mem-budget must not be negative")
+		os.Exit(1)
+	}
+	reactorBudget := *memBudget << 20 / reactorsNum
+	reactors := make([]*data.Reactor, 0, reactorsNum)
+	for i := 0; i < reactorsNum; i++ {
+		r, err := newReactor(listenSockaddrs, reactorsNum > 1, reactorBudget)
 		if err != nil {
-			log.Printf("close(%d) faile: %v", fd, err)
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		reactors = append(reactors, r)
+	}
+	for _, sa := range listenSockaddrs {
+		if reactorsNum > 1 {
+			fmt.Printf("listening on %s (%d reactors)\n", formatSockaddr(sa), reactorsNum)
+		} else {
+			fmt.Printf("listening on %s\n", formatSockaddr(sa))
+		}
+	}
+
+	if *accessLogPath != "" {
+		if *accessLogSize < 0 || *accessLogKeep < 0 {
+			fmt.Println("access-log-max-size and access-log-backups must not be negative")
+			os.Exit(1)
 		}
-	}(data.Epfd)
+		if err := accessLog.Open(*accessLogPath, int64(*accessLogSize)<<20, *accessLogKeep); err != nil {
+			fmt.Printf("open access log faile: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
-	if err := utils.EpollAdd(lnFD, unix.EPOLLIN); err != nil {
-		fmt.Printf("epoll add listen faile: %v\n", err)
-		os.Exit(1)
+	if *adminAddr != "" {
+		metrics.Init(len(reactors))
+		metrics.DNSCacheStats = dns.CacheStats
+		metrics.AccessLogDropped = accessLog.Dropped
+		if err := metrics.Serve(*adminAddr); err != nil {
+			fmt.Printf("admin listen faile: %v\n", err)
+			os.Exit(1)
+		}
+		for i, r := range reactors {
+			publishSnapshots(r, i)
+		}
+		fmt.Printf("admin on %s\n", *adminAddr)
 	}
 
-	dns.FD, err = unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0)
-	if err != nil {
-		fmt.Printf("dns socket faile: %v\n", err)
+	if *shutdownGrace < 0 {
+		fmt.Println("shutdown-grace must not be negative")
 		os.Exit(1)
 	}
-	defer func(fd int) {
-		if fd > 0 {
-			err := unix.Close(fd)
-			if err != nil {
+	signals := make(chan os.Signal, 4)
+	signal.Notify(signals, unix.SIGTERM, unix.SIGINT, unix.SIGHUP)
+	go watchSignals(signals, reactors)
+
+	var wg sync.WaitGroup
+	for _, r := range reactors {
+		wg.Add(1)
+		go func(r *data.Reactor) {
+			defer wg.Done()
+			runtime.LockOSThread()
+			eventLoop(r)
+			closeReactor(r)
+		}(r)
+	}
+	wg.Wait()
+	signal.Stop(signals)
+	// Workers may still post results, so the eventfds outlive them.
+	auth.StopWorkers()
+	for _, r := range reactors {
+		for _, fd := range []int{r.WakeFD, r.PostFD} {
+			if err := unix.Close(fd); err != nil {
 				log.Printf("close(%d) faile: %v", fd, err)
 			}
 		}
-	}(dns.FD)
-	if err := unix.SetNonblock(dns.FD, true); err != nil {
-		fmt.Printf("dns setnonblock faile: %v\n", err)
-		os.Exit(1)
+	}
+	accessLog.Close()
+	fmt.Println("shutdown complete")
+}
+
+func newReactor(listenSockaddrs []unix.Sockaddr, reusePort bool, budget int) (*data.Reactor, error) {
+	r := data.NewReactor()
+	r.Pool = bufferPool.New(budget)
 
+	var err error
+	r.Epfd, err = unix.EpollCreate1(0)
+	if err != nil {
+		return nil, fmt.Errorf("epoll_create1 faile: %v", err)
 	}
-	if err := utils.EpollAdd(dns.FD, unix.EPOLLIN); err != nil {
-		fmt.Printf("epoll add dns faile: %v\n", err)
-		os.Exit(1)
+	r.WakeFD, err = unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+	if err != nil {
+		closeReactor(r)
+		return nil, fmt.Errorf("eventfd faile: %v", err)
+	}
+	if err := utils.EpollAdd(r, r.WakeFD, unix.EPOLLIN); err != nil {
+		closeReactor(r)
+		return nil, fmt.Errorf("epoll add eventfd faile: %v", err)
+	}
+	r.PostFD, err = unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+	if err != nil {
+		closeReactor(r)
+		return nil, fmt.Errorf("eventfd faile: %v", err)
+	}
+	if err := utils.EpollAdd(r, r.PostFD, unix.EPOLLIN); err != nil {
+		closeReactor(r)
+		return nil, fmt.Errorf("epoll add eventfd faile: %v", err)
+	}
+	if err := connect.OpenReserve(r); err != nil {
+		closeReactor(r)
+		return nil, err
+	}
+	for _, sa := range listenSockaddrs {
+		fd, err := newListener(sa, reusePort, *ipv6Only)
+		if err != nil {
+			closeReactor(r)
+			return nil, err
+		}
+		r.ListenFDs = append(r.ListenFDs, fd)
+		if err := utils.EpollAdd(r, fd, unix.EPOLLIN); err != nil {
+			closeReactor(r)
+			return nil, fmt.Errorf("epoll add listen faile: %v", err)
+		}
+	}
+
+	r.Timers, err = timer.NewQueue()
+	if err != nil {
+		closeReactor(r)
+		return nil, fmt.Errorf("timerfd_create faile: %v", err)
+	}
+	if err := utils.EpollAdd(r, r.Timers.FD, unix.EPOLLIN); err != nil {
+		closeReactor(r)
+		return nil, fmt.Errorf("epoll add timer faile: %v", err)
 	}
 
+	if err := dns.OpenSockets(r); err != nil {
+		closeReactor(r)
+		return nil, err
+	}
+	return r, nil
+}
+
+func closeReactor(r *data.Reactor) {
+	if r.Timers != nil {
+		if err := r.Timers.Close(); err != nil {
+			log.Printf("close timerfd faile: %v", err)
+		}
+	}
+	for _, fd := range append([]int{r.DNSFD, r.DNSFD6, r.Epfd, r.ReserveFD}, r.ListenFDs...) {
+		if fd < 0 {
+			continue
+		}
+		err := unix.Close(fd)
+		if err != nil {
+			log.Printf("close(%d) faile: %v", fd, err)
+		}
+	}
+	r.DNSFD, r.DNSFD6, r.Epfd, r.ReserveFD, r.ListenFDs = -1, -1, -1, -1, nil
+}
+
+func eventLoop(r *data.Reactor) {
 	events := make([]unix.EpollEvent, data.MaxLenQueueListen)
 	for {
-		n, err := unix.EpollWait(data.Epfd, events, -1)
+		timeout := -1
+		if len(r.Resumed) > 0 {
+			timeout = 0
+		}
+		n, err := unix.EpollWait(r.Epfd, events, timeout)
 		if err != nil {
 			if errors.Is(err, unix.EINTR) {
 				continue
 			}
 			fmt.Printf("epoll_wait: %v\n", err)
-			utils.CleanupAllConnections()
+			utils.CleanupAllConnections(r)
 			return
 		}
 		for i := 0; i < n; i++ {
 			ev := events[i]
 			fd := int(ev.Fd)
-			if fd == lnFD {
+			if slices.Contains(r.ListenFDs, fd) {
+				if ev.Events&unix.EPOLLIN != 0 {
+					connect.AcceptLoop(r, fd)
+				}
+				continue
+			}
+
+			if fd == r.DNSFD || fd == r.DNSFD6 {
+				if ev.Events&unix.EPOLLIN != 0 {
+					dns.HandleDNSRead(r, fd)
+				}
+				continue
+			}
+
+			if fd == r.WakeFD {
 				if ev.Events&unix.EPOLLIN != 0 {
-					connect.AcceptLoop(lnFD)
+					handleWake(r)
 				}
 				continue
 			}
 
-			if fd == dns.FD {
+			if fd == r.PostFD {
 				if ev.Events&unix.EPOLLIN != 0 {
-					dns.HandleDNSRead()
+					utils.RunPosted(r)
 				}
 				continue
 			}
 
-			info := data.FdsInfo[fd]
+			if fd == r.Timers.FD {
+				if ev.Events&unix.EPOLLIN != 0 {
+					r.Timers.HandleExpired()
+				}
+				continue
+			}
+
+			info := r.FdsInfo[fd]
 			if info == nil {
-				delete(data.FdsInfo, fd)
+				delete(r.FdsInfo, fd)
+				continue
+			}
+			if info.Resolve != nil {
+				dns.HandleTCP(r, info.Resolve, ev.Events)
 				continue
 			}
-			if ev.Events&(unix.EPOLLHUP|unix.EPOLLERR) != 0 {
-				utils.CloseConn(info.Conn)
+			if info.IsConnectAttempt {
+				connect.HandleAttempt(r, info.Conn, fd, ev.Events)
+				continue
+			}
+			// A failed connect is reported as EPOLLERR; the write handler turns SO_ERROR into a reply.
+			if !info.IsClient && info.Conn.State == data.StateConnecting {
+				handlerWrite.Upstream(r, info.Conn)
+				continue
+			}
+			if info.Conn.EdgeTriggered && !info.IsUDPRelay {
+				handleEdge(r, info.Conn, info.IsClient, ev.Events)
+				continue
+			}
+			if ev.Events&unix.EPOLLERR != 0 || ev.Events&unix.EPOLLHUP != 0 && info.IsUDPRelay {
+				utils.CloseConn(r, info.Conn)
+				continue
+			}
+			if ev.Events&unix.EPOLLHUP != 0 {
+				handlerRead.Hangup(r, info.Conn, info.IsClient)
+				continue
+			}
+
+			if info.IsUDPRelay {
+				if ev.Events&unix.EPOLLIN != 0 {
+					udpRelay.HandleRead(r, info.Conn)
+				}
+				continue
+			}
+
+			if !info.IsClient && info.Conn.State == data.StateBinding {
+				if ev.Events&unix.EPOLLIN != 0 {
+					connect.AcceptBind(r, info.Conn)
+				}
 				continue
 			}
 
 			if info.IsClient {
 				if ev.Events&unix.EPOLLIN != 0 {
-					handlerRead.Client(info.Conn)
+					handlerRead.Client(r, info.Conn)
 				}
 				if ev.Events&unix.EPOLLOUT != 0 {
-					handlerWrite.Client(info.Conn)
+					handlerWrite.Client(r, info.Conn)
 				}
 			} else {
 				if ev.Events&unix.EPOLLIN != 0 {
-					handlerRead.Upstream(info.Conn)
+					handlerRead.Upstream(r, info.Conn)
 				}
 				if ev.Events&unix.EPOLLOUT != 0 {
-					handlerWrite.Upstream(info.Conn)
+					handlerWrite.Upstream(r, info.Conn)
 				}
 			}
 		}
+		runResumed(r)
+		if r.Draining && len(r.Conns) == 0 {
+			return
+		}
 	}
 }
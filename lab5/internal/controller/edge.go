@@ -0,0 +1,70 @@
+package controller
+
+import (
+	"lab5/internal/data"
+	"lab5/internal/handlerRead"
+	"lab5/internal/handlerWrite"
+	"lab5/internal/utils"
+
+	"golang.org/x/sys/unix"
+)
+
+// handleEdge serves an event on a relayed socket registered with EPOLLET. The event is only
+// reported once, so it is first recorded in the conn; reading then runs unless flow control or
+// shaping paused the direction, in which case the loop resumes it later from r.Resumed.
+func handleEdge(r *data.Reactor, conn *data.Conn, isClient bool, events uint32) {
+	if events&unix.EPOLLERR != 0 {
+		utils.CloseConn(r, conn)
+		return
+	}
+	// After EPOLLHUP the data still queued in the socket is read first; writing to it would fail.
+	readable := events&(unix.EPOLLIN|unix.EPOLLRDHUP|unix.EPOLLHUP) != 0
+	writable := events&unix.EPOLLOUT != 0 && events&unix.EPOLLHUP == 0
+	if isClient {
+		conn.ClientReadable = conn.ClientReadable || readable
+		conn.ClientWritable = conn.ClientWritable || writable
+	} else {
+		conn.UpstreamReadable = conn.UpstreamReadable || readable
+		conn.UpstreamWritable = conn.UpstreamWritable || writable
+	}
+	readEdge(r, conn, isClient)
+	if writable && conn.ClientFD >= 0 {
+		if isClient {
+			handlerWrite.Client(r, conn)
+		} else {
+			handlerWrite.Upstream(r, conn)
+		}
+	}
+	finishEdge(r, conn)
+}
+
+func readEdge(r *data.Reactor, conn *data.Conn, isClient bool) {
+	if conn.ClientFD < 0 {
+		return
+	}
+	if isClient && conn.ClientReadable && !conn.ClientReadPaused && !conn.ClientThrottled && !conn.ClientClosed {
+		handlerRead.Client(r, conn)
+	} else if !isClient && conn.UpstreamReadable && !conn.UpstreamReadPaused && !conn.UpstreamThrottled && !conn.UpstreamClosed {
+		handlerRead.Upstream(r, conn)
+	}
+}
+
+// finishEdge closes a relay once both sides are done; in level-triggered mode the repeated
+// EPOLLHUP does that through handlerRead.Hangup.
+func finishEdge(r *data.Reactor, conn *data.Conn) {
+	if conn.ClientFD >= 0 && utils.RelayDone(conn) {
+		utils.CloseConn(r, conn)
+	}
+}
+
+// runResumed reads the edge-triggered conns whose paused direction may read again.
+func runResumed(r *data.Reactor) {
+	resumed := r.Resumed
+	r.Resumed = nil
+	for _, conn := range resumed {
+		conn.ResumeQueued = false
+		readEdge(r, conn, true)
+		readEdge(r, conn, false)
+		finishEdge(r, conn)
+	}
+}
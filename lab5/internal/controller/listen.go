@@ -0,0 +1,100 @@
+package controller
+
+import (
+	"fmt"
+	"lab5/internal/data"
+	"lab5/internal/utils"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// parseListenAddrs turns "0.0.0.0,[::1]:1081" into socket addresses; entries without a port
+// listen on defaultPort. Unless ipv6Only is set, [::] also takes IPv4 clients, so it cannot share
+// a port with an IPv4 address.
+func parseListenAddrs(spec string, defaultPort int, ipv6Only bool) ([]unix.Sockaddr, error) {
+	var addrs []unix.Sockaddr
+	dualStackPorts := make(map[int]bool)
+	ipv4Ports := make(map[int]bool)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		host, port := entry, defaultPort
+		if net.ParseIP(entry) == nil {
+			if h, p, err := net.SplitHostPort(entry); err == nil {
+				host = h
+				if port, err = strconv.Atoi(p); err != nil {
+					return nil, fmt.Errorf("listen address %q: bad port", entry)
+				}
+			} else {
+				host = strings.TrimSuffix(strings.TrimPrefix(entry, "["), "]")
+			}
+		}
+		ip := net.ParseIP(host)
+		if ip == nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("listen address %q: expected ip, ip:port or [ipv6]:port", entry)
+		}
+		if ip.To4() != nil {
+			ipv4Ports[port] = true
+		} else if ip.IsUnspecified() && !ipv6Only {
+			dualStackPorts[port] = true
+		}
+		if dualStackPorts[port] && ipv4Ports[port] {
+			return nil, fmt.Errorf("listen address %q: [::] already takes IPv4 clients on port %d; drop the IPv4 address or set -ipv6only", entry, port)
+		}
+		addrs = append(addrs, utils.IPToSockaddr(ip, port, ip.To4() == nil))
+	}
+	return addrs, nil
+}
+
+func formatSockaddr(sa unix.Sockaddr) string {
+	ip, port := utils.SockaddrToIP(sa)
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
+}
+
+// newListener opens a non-blocking listening socket. IPv6 sockets accept IPv4 clients too
+// (as ::ffff:a.b.c.d) unless v6only is set.
+func newListener(sa unix.Sockaddr, reusePort bool, v6only bool) (int, error) {
+	family := unix.AF_INET
+	if _, isIPv6 := sa.(*unix.SockaddrInet6); isIPv6 {
+		family = unix.AF_INET6
+	}
+	fd, err := unix.Socket(family, unix.SOCK_STREAM, 0)
+	if err != nil {
+		return -1, fmt.Errorf("socket faile: %v", err)
+	}
+	fail := func(format string, err error) (int, error) {
+		if closeErr := unix.Close(fd); closeErr != nil {
+			log.Printf("close(%d) faile: %v", fd, closeErr)
+		}
+		return -1, fmt.Errorf(format, formatSockaddr(sa), err)
+	}
+
+	_ = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+	if reusePort {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
+			return fail("%s: setsockopt SO_REUSEPORT faile: %v", err)
+		}
+	}
+	if family == unix.AF_INET6 {
+		v6onlyValue := 0
+		if v6only {
+			v6onlyValue = 1
+		}
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, v6onlyValue); err != nil {
+			return fail("%s: setsockopt IPV6_V6ONLY faile: %v", err)
+		}
+	}
+	if err := unix.SetNonblock(fd, true); err != nil {
+		return fail("%s: setnonblock faile: %v", err)
+	}
+	if err := unix.Bind(fd, sa); err != nil {
+		return fail("%s: bind faile: %v", err)
+	}
+	if err := unix.Listen(fd, data.MaxLenQueueListen); err != nil {
+		return fail("%s: listen faile: %v", err)
+	}
+	return fd, nil
+}
@@ -0,0 +1,53 @@
+package controller
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseListenAddrs(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     string
+		ipv6Only bool
+		want     []string
+		fails    bool
+	}{
+		{name: "default port", spec: "0.0.0.0", want: []string{"0.0.0.0:1080"}},
+		{name: "ports and spaces", spec: "127.0.0.1:1081, [::1]:1082", want: []string{"127.0.0.1:1081", "[::1]:1082"}},
+		{name: "bare ipv6", spec: "::1", want: []string{"[::1]:1080"}},
+		{name: "bracketed ipv6 without a port", spec: "[::1]", want: []string{"[::1]:1080"}},
+		{name: "dual stack alone", spec: "[::]", want: []string{"[::]:1080"}},
+		{name: "ipv4 and ipv6 loopback on one port", spec: "127.0.0.1,::1", want: []string{"127.0.0.1:1080", "[::1]:1080"}},
+		{name: "ipv4 and [::] on other ports", spec: "0.0.0.0,[::]:1081", want: []string{"0.0.0.0:1080", "[::]:1081"}},
+		{name: "ipv4 then [::]", spec: "0.0.0.0,[::]", fails: true},
+		{name: "[::] then ipv4", spec: "[::]:1081,127.0.0.1:1081", fails: true},
+		{name: "bare :: next to ipv4", spec: "127.0.0.1,::", fails: true},
+		{name: "ipv4 and [::] with ipv6only", spec: "0.0.0.0,[::]", ipv6Only: true, want: []string{"0.0.0.0:1080", "[::]:1080"}},
+		{name: "host name", spec: "localhost:1080", fails: true},
+		{name: "bad port", spec: "127.0.0.1:http", fails: true},
+		{name: "port out of range", spec: "127.0.0.1:65536", fails: true},
+		{name: "empty entry", spec: "127.0.0.1,", fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addrs, err := parseListenAddrs(tt.spec, 1080, tt.ipv6Only)
+			if tt.fails {
+				if err == nil {
+					t.Fatalf("parseListenAddrs(%q) = %d addresses, want an error", tt.spec, len(addrs))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseListenAddrs(%q): %v", tt.spec, err)
+			}
+			var got []string
+			for _, sa := range addrs {
+				got = append(got, formatSockaddr(sa))
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("parseListenAddrs(%q) = %v; want %v", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package controller
+
+import (
+	"encoding/binary"
+	"fmt"
+	"lab5/internal/acl"
+	"lab5/internal/auth"
+	"lab5/internal/chain"
+	"lab5/internal/data"
+	"lab5/internal/rateLimit"
+	"lab5/internal/utils"
+	"log"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchSignals reloads the configuration on SIGHUP and passes SIGTERM/SIGINT to every reactor
+// through its eventfd: the first one starts draining, a second one closes everything at once.
+func watchSignals(signals chan os.Signal, reactors []*data.Reactor) {
+	draining := false
+	for sig := range signals {
+		if sig == unix.SIGHUP {
+			reloadConfig()
+			continue
+		}
+		if draining {
+			fmt.Printf("%v: closing all connections\n", sig)
+		} else {
+			fmt.Printf("%v: shutting down, grace period %v\n", sig, *shutdownGrace)
+		}
+		draining = true
+		wake := binary.NativeEndian.AppendUint64(nil, 1)
+		for _, r := range reactors {
+			if _, err := unix.Write(r.WakeFD, wake); err != nil {
+				log.Printf("eventfd write faile: %v", err)
+			}
+		}
+	}
+}
+
+// reloadConfig re-reads the access rules, routes and users; a file that fails to load keeps its
+// old contents. Established connections are not affected.
+func reloadConfig() {
+	if *aclFile != "" {
+		if rules, err := acl.Load(*aclFile); err != nil {
+			fmt.Printf("reload acl faile: %v\n", err)
+		} else {
+			acl.SetRules(rules)
+			fmt.Printf("acl reloaded: %d rules\n", rules.Len())
+		}
+	}
+	if *chainFile != "" {
+		if routes, err := chain.Load(*chainFile); err != nil {
+			fmt.Printf("reload chain faile: %v\n", err)
+		} else {
+			chain.SetRoutes(routes)
+			fmt.Printf("chain reloaded: %d routes\n", routes.Len())
+		}
+	}
+	if *limitsFile != "" {
+		if limits, err := rateLimit.Load(*limitsFile); err != nil {
+			fmt.Printf("reload limits faile: %v\n", err)
+		} else {
+			rateLimit.SetLimits(limits)
+			fmt.Printf("limits reloaded: %d lines\n", limits.Len())
+		}
+	}
+	if store, ok := auth.Store.(*auth.HtpasswdStore); ok {
+		if users, err := store.Reload(*authFile); err != nil {
+			fmt.Printf("reload auth faile: %v\n", err)
+		} else {
+			fmt.Printf("auth reloaded: %d users\n", users)
+		}
+	}
+}
+
+func handleWake(r *data.Reactor) {
+	buffer := make([]byte, 8)
+	if _, err := unix.Read(r.WakeFD, buffer); err != nil {
+		return
+	}
+	// Two signals may arrive before the eventfd is read; the listeners still have to be closed.
+	requests := binary.NativeEndian.Uint64(buffer)
+	if !r.Draining {
+		startDrain(r)
+		requests--
+	}
+	if requests > 0 {
+		utils.CleanupAllConnections(r)
+	}
+}
+
+// startDrain stops accepting and gives the open connections the grace period to finish.
+func startDrain(r *data.Reactor) {
+	r.Draining = true
+	for _, fd := range r.ListenFDs {
+		utils.EpollDel(r, fd)
+		if err := unix.Close(fd); err != nil {
+			log.Printf("close(%d) faile: %v", fd, err)
+		}
+	}
+	r.ListenFDs = nil
+	r.Timers.Add(*shutdownGrace, func() { utils.CleanupAllConnections(r) })
+}
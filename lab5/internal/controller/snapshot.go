@@ -0,0 +1,45 @@
+package controller
+
+import (
+	"lab5/internal/data"
+	"lab5/internal/metrics"
+	"net"
+	"strconv"
+	"time"
+)
+
+// publishSnapshots copies the reactor's counters and connection table for the admin listener
+// every metrics.SnapshotInterval. It runs on the reactor's own thread from its timer queue.
+func publishSnapshots(r *data.Reactor, reactor int) {
+	now := time.Now()
+	snapshot := &metrics.Snapshot{
+		Stats:     r.Stats,
+		Conns:     make([]metrics.ConnInfo, 0, len(r.Conns)),
+		PoolInUse: r.Pool.InUse(),
+		Taken:     now,
+	}
+	for _, conn := range r.Conns {
+		client, target := "", ""
+		if conn.ClientIP != nil {
+			client = conn.ClientIP.String()
+		}
+		if conn.TargetHost != "" {
+			target = net.JoinHostPort(conn.TargetHost, strconv.Itoa(conn.TargetPort))
+		}
+		snapshot.Conns = append(snapshot.Conns, metrics.ConnInfo{
+			Reactor:   reactor,
+			Client:    client,
+			User:      conn.Username,
+			Protocol:  data.ProtocolNames[conn.Protocol],
+			State:     data.StateNames[conn.State],
+			Target:    target,
+			Upstream:  conn.Upstream,
+			BytesUp:   conn.BytesUp,
+			BytesDown: conn.BytesDown,
+			Age:       now.Sub(conn.AcceptedAt).Seconds(),
+			Idle:      now.Sub(conn.LastActivity).Seconds(),
+		})
+	}
+	metrics.Publish(reactor, snapshot)
+	r.Timers.Add(metrics.SnapshotInterval, func() { publishSnapshots(r, reactor) })
+}
@@ -1,11 +1,33 @@
 package data
 
-import "bytes"
+import (
+	"bytes"
+	"lab5/internal/bufferPool"
+	"lab5/internal/metrics"
+	"lab5/internal/rateLimit"
+	"lab5/internal/timer"
+	"net"
+	"sync"
+	"time"
+)
 
 const (
-	SocksVer          = 0x05
-	SocksMethodNoAuth = 0x00
-	SocksCmdConnect   = 0x01
+	SocksVer                = 0x05
+	SocksMethodNoAuth       = 0x00
+	SocksMethodUserPass     = 0x02
+	SocksMethodNoAcceptable = 0xFF
+	SocksCmdConnect         = 0x01
+	SocksCmdBind            = 0x02
+	SocksCmdUDPAssociate    = 0x03
+
+	Socks4Ver         = 0x04
+	Socks4RepGranted  = 0x5A
+	Socks4RepRejected = 0x5B
+	Socks4ReplyVer    = 0x00
+
+	AuthVer           = 0x01
+	AuthStatusSuccess = 0x00
+	AuthStatusFailure = 0x01
 
 	AtypIPv4   = 0x01
 	AtypDomain = 0x03
@@ -13,6 +35,11 @@ const (
 
 	RepSuccess              = 0x00
 	RepGeneralFailure       = 0x01
+	RepConnectionNotAllowed = 0x02
+	RepNetworkUnreachable   = 0x03
+	RepHostUnreachable      = 0x04
+	RepConnectionRefused    = 0x05
+	RepTTLExpired           = 0x06
 	RepCommandNotSupported  = 0x07
 	RepAddrTypeNotSupported = 0x08
 
@@ -20,38 +47,274 @@ const (
 
 	HandlerBufferSize = 32 * 1024
 
-	MaxBufferSizeForClient = 8 * 1024 * 1024
+	// Reading from one side stops while the buffer towards the other side is above the
+	// high-water mark and resumes once it drains below the low-water mark.
+	BufferHighWatermark = 1024 * 1024
+	BufferLowWatermark  = 256 * 1024
+
+	UDPBufferSize = 64 * 1024
+
+	SplicePipeSize = 256 * 1024
 )
 
 const (
-	StateGreeting   = 0
-	StateRequest    = 1
-	StateConnecting = 2
-	StateRelaying   = 3
-	StateResolving  = 4
+	StateGreeting      = 0
+	StateRequest       = 1
+	StateConnecting    = 2
+	StateRelaying      = 3
+	StateResolving     = 4
+	StateAuth          = 5
+	StateUDPAssociated = 6
+	StateBinding       = 7
+	StateChaining      = 8
+)
+
+// Protocol is detected from the first byte a client sends; replies are written in its format.
+const (
+	ProtocolSocks5 = 0
+	ProtocolHTTP   = 1
+	ProtocolSocks4 = 2
+)
+
+// Names used by the admin listener and the access log.
+var (
+	StateNames = map[int]string{
+		StateGreeting:      "greeting",
+		StateAuth:          "auth",
+		StateRequest:       "request",
+		StateResolving:     "resolving",
+		StateConnecting:    "connecting",
+		StateChaining:      "chaining",
+		StateBinding:       "binding",
+		StateRelaying:      "relaying",
+		StateUDPAssociated: "udp_associated",
+	}
+	ProtocolNames = map[int]string{
+		ProtocolSocks5: "socks5",
+		ProtocolSocks4: "socks4",
+		ProtocolHTTP:   "http",
+	}
+	CommandNames = map[byte]string{
+		SocksCmdConnect:      "connect",
+		SocksCmdBind:         "bind",
+		SocksCmdUDPAssociate: "udp_associate",
+	}
+	AtypNames = map[byte]string{
+		AtypIPv4:   "ipv4",
+		AtypDomain: "domain",
+		AtypIPv6:   "ipv6",
+	}
 )
 
 type Conn struct {
 	ClientFD   int
 	UpstreamFD int
+	UDPRelayFD int
+
+	ClientIP   net.IP
+	ClientPort int
+	Protocol   int
+
+	// Counted connections hold a slot of the connection limits.
+	Counted bool
 
+	// AuthPending is set while an auth worker checks the password; the client is not read until
+	// the answer is posted back, then the handshake continues with what it had sent.
+	AuthPending bool
+
+	BindExpectedIP net.IP
+
+	Race *ConnectRace
+
+	Chain *ChainHandshake
+
+	UDPRelayIsIPv6 bool
+	UDPClientIP    net.IP
+	UDPClientPort  int
+
+	// HandshakeBuffer is released once the request is parsed.
 	HandshakeBuffer bytes.Buffer
 
-	ClientToUpstreamBuffer bytes.Buffer
-	UpstreamToClientBuffer bytes.Buffer
+	ClientToUpstreamBuffer bufferPool.Queue
+	UpstreamToClientBuffer bufferPool.Queue
+
+	// Pipes are set only in splice mode; a direction uses its pipe once its buffer has drained.
+	ClientToUpstreamPipe *SplicePipe
+	UpstreamToClientPipe *SplicePipe
+
+	Username string
+
+	// Command, TargetAtyp, TargetHost and TargetPort are the request as the client sent it and
+	// Upstream the address actually connected to. Reply is the last reply code sent, if Replied.
+	Command    byte
+	TargetAtyp byte
+	TargetHost string
+	TargetPort int
+	Upstream   string
+	Reply      byte
+	Replied    bool
+	BytesUp    uint64
+	BytesDown  uint64
+
+	// Phase timestamps for metrics and the access log; ResolvedAt is set only for domain requests.
+	AcceptedAt  time.Time
+	RequestAt   time.Time
+	ResolvedAt  time.Time
+	ConnectedAt time.Time
+
+	// Deadline is the timeout of the current phase: handshake, connect or idle.
+	Deadline     *timer.Timer
+	LastActivity time.Time
 
 	State          int
 	ClientClosed   bool
 	UpstreamClosed bool
+
+	ClientReadPaused   bool
+	UpstreamReadPaused bool
+
+	// EdgeTriggered is set when relaying starts in edge-triggered mode: both sockets are then
+	// registered once for IN|OUT|RDHUP and the readiness reported by epoll is kept here until a
+	// read or write hits EAGAIN. ResumeQueued means the conn is in Reactor.Resumed. A socket
+	// whose reading stays paused is InMasked: EPOLLIN is off so arriving data does not wake the loop.
+	EdgeTriggered    bool
+	ClientReadable   bool
+	ClientWritable   bool
+	UpstreamReadable bool
+	UpstreamWritable bool
+	ResumeQueued     bool
+	ClientInMasked   bool
+	UpstreamInMasked bool
+
+	// Limits is set once relaying starts if rate limits apply. A direction whose buckets ran dry
+	// is Throttled and stops reading until its timer fires.
+	Limits            *rateLimit.Set
+	ClientThrottled   bool
+	UpstreamThrottled bool
+	ClientThrottle    *timer.Timer
+	UpstreamThrottle  *timer.Timer
+}
+
+// SplicePipe moves one direction of a relayed connection socket->pipe->socket inside the kernel.
+type SplicePipe struct {
+	ReadFD  int
+	WriteFD int
+	Size    int
+	Pending int
+	// Full is set when a splice into the pipe got EAGAIN while it still held data: the pipe ran
+	// out of buffer slots before bytes, and the socket may still be readable.
+	Full bool
+}
+
+// ChainHandshake is the client side of the handshake with a parent proxy; the upstream socket is
+// connected to the parent and Host/Port is where the parent has to connect on our behalf.
+type ChainHandshake struct {
+	IsHTTP   bool
+	Username string
+	Password string
+	Host     string
+	Port     int
+	Step     int
+	Out      []byte
+	In       []byte
+}
+
+// ConnectRace tracks RFC 8305 connection attempts for a domain CONNECT.
+type ConnectRace struct {
+	Domain         string
+	Port           int
+	IPv6Addrs      []net.IP
+	IPv4Addrs      []net.IP
+	NextIsIPv6     bool
+	PendingAnswers int
+	Started        bool
+	Tried          int
+	Denied         bool
+	LastErr        error
+	Attempts       []int
+	Timer          *timer.Timer
 }
 
 type FDInfo struct {
-	Conn     *Conn
-	IsClient bool
+	Conn             *Conn
+	IsClient         bool
+	IsUDPRelay       bool
+	IsConnectAttempt bool
+	Resolve          *PendingResolve
 }
 
-var (
-	Epfd    int
-	FdsInfo = make(map[int]*FDInfo)
-	Conns   = make(map[int]*Conn)
-)
+type PendingResolve struct {
+	Conn   *Conn
+	Domain string
+	Port   int
+	IsIPv6 bool
+
+	// OnResolved replaces the default upstream connect when set; failures are dropped silently.
+	OnResolved func(ip string)
+
+	ID          uint16
+	Query       []byte
+	ServerIndex int
+	Tries       int
+	SentAt      time.Time
+	Timer       *timer.Timer
+
+	// TCP fallback after a truncated UDP answer.
+	TCPFD  int
+	TCPOut []byte
+	TCPIn  []byte
+}
+
+// Reactor owns one epoll loop together with every descriptor registered in it.
+type Reactor struct {
+	Epfd      int
+	ListenFDs []int
+	FdsInfo   map[int]*FDInfo
+	Conns     map[int]*Conn
+	Timers    *timer.Queue
+
+	// WakeFD is an eventfd the signal goroutine writes to; each write asks the reactor to shut down.
+	// While Draining the listeners are closed and the loop ends once the last connection is gone.
+	WakeFD   int
+	Draining bool
+
+	// PostFD is an eventfd that other goroutines write to after appending to Posted; the loop then
+	// runs the posted functions, which is how results computed off the loop get back to it.
+	PostFD int
+	PostMu sync.Mutex
+	Posted []func()
+
+	// Resumed holds edge-triggered conns whose reading was paused while data was waiting; the
+	// loop reads them itself since epoll will not report that data again.
+	Resumed []*Conn
+
+	// ReserveFD is an open /dev/null given up to shed connections when accept fails with EMFILE.
+	ReserveFD int
+
+	Stats metrics.Stats
+
+	// Pool backs the relay buffers of every connection; ReadBuffer is the scratch space for reads.
+	Pool       *bufferPool.Pool
+	ReadBuffer []byte
+
+	DNSFD           int
+	DNSFD6          int
+	DNSServerIndex  int
+	PendingResolves map[uint16]*PendingResolve
+}
+
+func NewReactor() *Reactor {
+	return &Reactor{
+		Epfd:            -1,
+		WakeFD:          -1,
+		PostFD:          -1,
+		ReserveFD:       -1,
+		FdsInfo:         make(map[int]*FDInfo),
+		Conns:           make(map[int]*Conn),
+		Pool:            bufferPool.New(0),
+		ReadBuffer:      make([]byte, UDPBufferSize),
+		DNSFD:           -1,
+		DNSFD6:          -1,
+		PendingResolves: make(map[uint16]*PendingResolve),
+	}
+}
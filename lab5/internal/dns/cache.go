@@ -0,0 +1,98 @@
+package dns
+
+import (
+	"container/list"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	maxPositiveTTL = 24 * time.Hour
+	maxNegativeTTL = 3 * time.Hour
+)
+
+// CacheSize bounds the number of cached (name, type) entries; 0 disables caching.
+var CacheSize = 1024
+
+type cacheKey struct {
+	domain string
+	isIPv6 bool
+}
+
+type cacheEntry struct {
+	key     cacheKey
+	ips     []net.IP
+	expires time.Time
+}
+
+// The cache is shared by all reactors, hence the mutex.
+var cache = struct {
+	sync.Mutex
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+}{entries: make(map[cacheKey]*list.Element), lru: list.New()}
+
+var cacheHits, cacheMisses atomic.Uint64
+
+// lookupCache reports whether the answer is cached; an empty slice is a cached negative answer.
+func lookupCache(domain string, isIPv6 bool) ([]net.IP, bool) {
+	if CacheSize <= 0 {
+		return nil, false
+	}
+	key := cacheKey{domain: strings.ToLower(domain), isIPv6: isIPv6}
+
+	cache.Lock()
+	defer cache.Unlock()
+	element, ok := cache.entries[key]
+	if !ok {
+		cacheMisses.Add(1)
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		cache.lru.Remove(element)
+		delete(cache.entries, key)
+		cacheMisses.Add(1)
+		return nil, false
+	}
+	cache.lru.MoveToFront(element)
+	cacheHits.Add(1)
+	return entry.ips, true
+}
+
+func storeCache(domain string, isIPv6 bool, ips []net.IP, ttl time.Duration) {
+	if CacheSize <= 0 || ttl <= 0 {
+		return
+	}
+	if len(ips) > 0 {
+		ttl = min(ttl, maxPositiveTTL)
+	} else {
+		ttl = min(ttl, maxNegativeTTL)
+	}
+	key := cacheKey{domain: strings.ToLower(domain), isIPv6: isIPv6}
+	entry := &cacheEntry{key: key, ips: ips, expires: time.Now().Add(ttl)}
+
+	cache.Lock()
+	defer cache.Unlock()
+	if element, ok := cache.entries[key]; ok {
+		element.Value = entry
+		cache.lru.MoveToFront(element)
+		return
+	}
+	cache.entries[key] = cache.lru.PushFront(entry)
+	for cache.lru.Len() > CacheSize {
+		oldest := cache.lru.Back()
+		cache.lru.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+func CacheStats() (hits uint64, misses uint64, size int) {
+	cache.Lock()
+	size = cache.lru.Len()
+	cache.Unlock()
+	return cacheHits.Load(), cacheMisses.Load(), size
+}
@@ -0,0 +1,119 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func resetCache(t *testing.T, size int) {
+	t.Helper()
+	saved := CacheSize
+	CacheSize = size
+	clear(cache.entries)
+	cache.lru.Init()
+	t.Cleanup(func() {
+		CacheSize = saved
+		clear(cache.entries)
+		cache.lru.Init()
+	})
+}
+
+func TestCacheHitAndMiss(t *testing.T) {
+	resetCache(t, 16)
+	hits, misses, _ := CacheStats()
+	ip := net.IPv4(192, 0, 2, 1)
+
+	if _, ok := lookupCache("example.com", false); ok {
+		t.Fatal("empty cache hit")
+	}
+	storeCache("Example.COM", false, []net.IP{ip}, time.Minute)
+	ips, ok := lookupCache("example.com", false)
+	if !ok || len(ips) != 1 || !ips[0].Equal(ip) {
+		t.Fatalf("lookupCache() = %v, %v", ips, ok)
+	}
+	if _, ok := lookupCache("example.com", true); ok {
+		t.Error("A answer returned for AAAA")
+	}
+
+	newHits, newMisses, size := CacheStats()
+	if newHits-hits != 1 || newMisses-misses != 2 || size != 1 {
+		t.Errorf("stats: %d hits, %d misses, %d entries", newHits-hits, newMisses-misses, size)
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	resetCache(t, 16)
+	storeCache("example.com", false, []net.IP{net.IPv4(192, 0, 2, 1)}, time.Minute)
+	cache.entries[cacheKey{domain: "example.com"}].Value.(*cacheEntry).expires = time.Now().Add(-time.Second)
+
+	if _, ok := lookupCache("example.com", false); ok {
+		t.Fatal("expired entry returned")
+	}
+	if _, _, size := CacheStats(); size != 0 {
+		t.Errorf("expired entry kept, %d entries", size)
+	}
+}
+
+func TestCacheTTLLimits(t *testing.T) {
+	resetCache(t, 16)
+	storeCache("positive.example", false, []net.IP{net.IPv4(192, 0, 2, 1)}, 7*24*time.Hour)
+	storeCache("negative.example", false, []net.IP{}, 7*24*time.Hour)
+	storeCache("zero.example", false, []net.IP{net.IPv4(192, 0, 2, 1)}, 0)
+
+	deadline := func(domain string) time.Duration {
+		return time.Until(cache.entries[cacheKey{domain: domain}].Value.(*cacheEntry).expires)
+	}
+	if d := deadline("positive.example"); d > maxPositiveTTL || d < maxPositiveTTL-time.Minute {
+		t.Errorf("positive ttl %v, want %v", d, maxPositiveTTL)
+	}
+	if d := deadline("negative.example"); d > maxNegativeTTL || d < maxNegativeTTL-time.Minute {
+		t.Errorf("negative ttl %v, want %v", d, maxNegativeTTL)
+	}
+	if ips, ok := lookupCache("negative.example", false); !ok || len(ips) != 0 {
+		t.Errorf("negative answer: %v, %v", ips, ok)
+	}
+	if _, ok := lookupCache("zero.example", false); ok {
+		t.Error("answer with ttl 0 cached")
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	resetCache(t, 2)
+	ip := []net.IP{net.IPv4(192, 0, 2, 1)}
+	storeCache("a.example", false, ip, time.Minute)
+	storeCache("b.example", false, ip, time.Minute)
+	lookupCache("a.example", false)
+	storeCache("c.example", false, ip, time.Minute)
+
+	for domain, want := range map[string]bool{"a.example": true, "b.example": false, "c.example": true} {
+		if _, ok := lookupCache(domain, false); ok != want {
+			t.Errorf("%s cached = %v, want %v", domain, ok, want)
+		}
+	}
+	if _, _, size := CacheStats(); size != 2 {
+		t.Errorf("%d entries, want 2", size)
+	}
+}
+
+func TestCacheUpdateKeepsOneEntry(t *testing.T) {
+	resetCache(t, 16)
+	storeCache("example.com", false, []net.IP{net.IPv4(192, 0, 2, 1)}, time.Minute)
+	storeCache("example.com", false, []net.IP{net.IPv4(192, 0, 2, 2)}, time.Minute)
+
+	ips, ok := lookupCache("example.com", false)
+	if !ok || len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 0, 2, 2)) {
+		t.Errorf("lookupCache() = %v, %v", ips, ok)
+	}
+	if _, _, size := CacheStats(); size != 1 {
+		t.Errorf("%d entries, want 1", size)
+	}
+}
+
+func TestCacheDisabled(t *testing.T) {
+	resetCache(t, 0)
+	storeCache("example.com", false, []net.IP{net.IPv4(192, 0, 2, 1)}, time.Minute)
+	if _, ok := lookupCache("example.com", false); ok {
+		t.Error("disabled cache returned an answer")
+	}
+}
@@ -10,23 +10,11 @@ import (
 	"lab5/internal/utils"
 	"math/rand"
 	"net"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
 
-type PendingResolve struct {
-	Conn   *data.Conn
-	Domain string
-	Port   int
-	IsIPv6 bool
-}
-
-var (
-	FD              int = -1
-	pendingResolves     = make(map[uint16]*PendingResolve)
-	dnsResolverAddr     = &unix.SockaddrInet4{Port: 53, Addr: [4]byte{8, 8, 8, 8}}
-)
-
 const (
 	flags              uint16 = 0x0100 // QR=0, OPCODE=0, RD=1
 	questionsCount     uint16 = 1
@@ -37,6 +25,7 @@ const (
 	limitCharInLabelLen = 63
 
 	dnsTypeA    uint16 = 1
+	dnsTypeSOA  uint16 = 6
 	dnsTypeAAAA uint16 = 28
 
 	dnsClassIN uint16 = 1
@@ -46,10 +35,13 @@ const (
 	dnsFlagsOffset   = 2
 	dnsQDCountOffset = 4
 	dnsANCountOffset = 6
+	dnsNSCountOffset = 8
 
 	dnsQRMask    = 0x8000
 	dnsRcodeMask = 0x000F
 
+	dnsRcodeNXDomain = 3
+
 	dnsPointerMask = 0xC0
 
 	dnsAnswerMinSize = 10
@@ -58,6 +50,8 @@ const (
 	dnsIPv4Size      = 4
 	dnsIPv6Size      = 16
 
+	dnsSOAMinimumSize = 4
+
 	dnsQRResponse = 1
 
 	maxDnsID                     = 0xFFFF
@@ -66,6 +60,12 @@ const (
 	dnsBufferSize = 4 * 1024
 )
 
+var (
+	QueryTimeout = 2 * time.Second
+	// QueryRetries is the number of retransmissions after the first query; each one goes to the next resolver.
+	QueryRetries = 2
+)
+
 func buildDNSQuery(id uint16, name string, isIPv6 bool) ([]byte, error) {
 	dnsQuery := &bytes.Buffer{}
 	_ = binary.Write(dnsQuery, binary.BigEndian, id)
@@ -94,137 +94,127 @@ func buildDNSQuery(id uint16, name string, isIPv6 bool) ([]byte, error) {
 	return dnsQuery.Bytes(), nil
 }
 
-func parseDNSResponse(dnsResponse []byte, isIPv6 bool) (uint16, string, error) {
-	if len(dnsResponse) < dnsHeaderSize {
-		return 0, "", fmt.Errorf("short dns response")
+func SendDNSQuery(r *data.Reactor, domain string, p *data.PendingResolve) (uint16, error) {
+	if len(resolvers) == 0 {
+		return 0, fmt.Errorf("no dns resolvers configured")
 	}
 
-	id := binary.BigEndian.Uint16(dnsResponse[dnsIDOffset : dnsIDOffset+2])
-	flags := binary.BigEndian.Uint16(dnsResponse[dnsFlagsOffset : dnsFlagsOffset+2])
-
-	if (flags&dnsQRMask)>>15 != dnsQRResponse {
-		return id, "", fmt.Errorf("not a response")
+	var id uint16
+	for tries := 0; tries < maxRetryAttemptsForFindDnsID; tries++ {
+		id = uint16(rand.Intn(maxDnsID))
+		if _, exists := r.PendingResolves[id]; !exists {
+			break
+		}
+		if tries == maxRetryAttemptsForFindDnsID-1 {
+			return 0, fmt.Errorf("faile to find free dns id")
+		}
 	}
 
-	rcode := flags & dnsRcodeMask
-	if rcode != 0 {
-		return id, "", fmt.Errorf("rcode=%d", rcode)
+	dnsQuery, err := buildDNSQuery(id, domain, p.IsIPv6)
+	if err != nil {
+		return 0, err
 	}
 
-	qdcount := int(binary.BigEndian.Uint16(dnsResponse[dnsQDCountOffset : dnsQDCountOffset+2]))
-	ancount := int(binary.BigEndian.Uint16(dnsResponse[dnsANCountOffset : dnsANCountOffset+2]))
-
-	offset := dnsHeaderSize
-	for i := 0; i < qdcount; i++ {
-		for {
-			if offset >= len(dnsResponse) {
-				return id, "", fmt.Errorf("uncorrect response")
-			}
-			labelLength := int(dnsResponse[offset])
-			offset++
-			if labelLength == 0 {
-				break
-			}
-			offset += labelLength
-		}
-		offset += dnsTypeClassSize
+	p.ID = id
+	p.Query = dnsQuery
+	p.ServerIndex = r.DNSServerIndex % len(resolvers)
+	p.Tries = 0
+	p.SentAt = time.Now()
+	r.Stats.DNSQueries++
+	if err := sendToNextAvailable(r, id, p); err != nil {
+		return 0, err
 	}
 
-	var expectedType uint16
-	var expectedSize int
-	if isIPv6 {
-		expectedType = dnsTypeAAAA
-		expectedSize = dnsIPv6Size
-	} else {
-		expectedType = dnsTypeA
-		expectedSize = dnsIPv4Size
-	}
+	r.PendingResolves[id] = p
+	return id, nil
+}
 
-	for i := 0; i < ancount; i++ {
-		if offset+dnsAnswerMinSize > len(dnsResponse) {
-			return id, "", fmt.Errorf("short answer")
+// ResolveAndConnect queries A and AAAA records in parallel; the connection race starts as the answers arrive.
+func ResolveAndConnect(r *data.Reactor, conn *data.Conn, domain string, port int) error {
+	race := &data.ConnectRace{Domain: domain, Port: port, NextIsIPv6: true, PendingAnswers: 2}
+	conn.Race = race
+
+	var cached [][]net.IP
+	var cachedFamilies []bool
+	var lastErr error
+	for _, isIPv6 := range []bool{true, false} {
+		if ips, ok := lookupCache(domain, isIPv6); ok {
+			cached = append(cached, ips)
+			cachedFamilies = append(cachedFamilies, isIPv6)
+			continue
 		}
-		if dnsResponse[offset]&dnsPointerMask == dnsPointerMask {
-			offset += 2
-		} else {
-			for {
-				if offset >= len(dnsResponse) {
-					return id, "", fmt.Errorf("uncorrect answer name")
-				}
-				labelLength := int(dnsResponse[offset])
-				offset++
-				if labelLength == 0 {
-					break
-				}
-				offset += labelLength
-			}
+		pr := &data.PendingResolve{Conn: conn, Domain: domain, Port: port, IsIPv6: isIPv6}
+		if _, err := SendDNSQuery(r, domain, pr); err != nil {
+			lastErr = err
+			race.PendingAnswers--
 		}
-		typ := binary.BigEndian.Uint16(dnsResponse[offset : offset+2])
-		offset += 2
-
-		class := binary.BigEndian.Uint16(dnsResponse[offset : offset+2])
-		offset += 2
-
-		offset += dnsTTLSize
-
-		rdlen := int(binary.BigEndian.Uint16(dnsResponse[offset : offset+2]))
-		offset += 2
+	}
+	if race.PendingAnswers == 0 {
+		conn.Race = nil
+		return lastErr
+	}
 
-		if offset+rdlen > len(dnsResponse) {
-			return id, "", fmt.Errorf("rdata out of bounds")
-		}
-		rdata := dnsResponse[offset : offset+rdlen]
-		offset += rdlen
-
-		if typ == expectedType && class == dnsClassIN && rdlen == expectedSize {
-			var ip string
-			if isIPv6 {
-				if len(rdata) == dnsIPv6Size {
-					ip = net.IP(rdata).String()
-				}
-			} else {
-				if len(rdata) == dnsIPv4Size {
-					ip = net.IPv4(rdata[0], rdata[1], rdata[2], rdata[3]).String()
-				}
-			}
+	for i, ips := range cached {
+		connect.AddRaceAddresses(r, conn, ips, cachedFamilies[i])
+	}
+	return nil
+}
 
-			if ip != "" {
-				return id, ip, nil
-			}
+// Resolve looks up an A record for callers that only need one address, such as the UDP relay.
+func Resolve(r *data.Reactor, conn *data.Conn, domain string, onResolved func(ip string)) error {
+	if ips, ok := lookupCache(domain, false); ok {
+		if len(ips) > 0 {
+			onResolved(ips[0].String())
 		}
+		return nil
 	}
-	return id, "", fmt.Errorf("no record found")
+	pr := &data.PendingResolve{Conn: conn, Domain: domain, OnResolved: onResolved}
+	_, err := SendDNSQuery(r, domain, pr)
+	return err
 }
 
-func SendDNSQuery(domain string, p *PendingResolve) (uint16, error) {
-	var id uint16
-	for tries := 0; tries < maxRetryAttemptsForFindDnsID; tries++ {
-		id = uint16(rand.Intn(maxDnsID))
-		if _, exists := pendingResolves[id]; !exists {
-			break
+// sendToNextAvailable sends the query starting at p.ServerIndex and moves on to the
+// following resolvers while sending fails, e.g. for an IPv6 resolver on an IPv4-only host.
+func sendToNextAvailable(r *data.Reactor, id uint16, p *data.PendingResolve) error {
+	err := errors.New("dns retries exhausted")
+	for ; p.Tries <= QueryRetries; p.Tries++ {
+		sa := resolvers[p.ServerIndex]
+		fd := r.DNSFD
+		if _, isIPv6 := sa.(*unix.SockaddrInet6); isIPv6 {
+			fd = r.DNSFD6
 		}
-		if tries == maxRetryAttemptsForFindDnsID-1 {
-			return 0, fmt.Errorf("faile to find free dns id")
+		if err = unix.Sendto(fd, p.Query, 0, sa); err == nil {
+			p.Timer = r.Timers.Add(QueryTimeout, func() { onQueryTimeout(r, id) })
+			return nil
 		}
+		p.ServerIndex = (p.ServerIndex + 1) % len(resolvers)
 	}
+	return err
+}
 
-	dnsQuery, err := buildDNSQuery(id, domain, p.IsIPv6)
-	if err != nil {
-		return 0, err
+func onQueryTimeout(r *data.Reactor, id uint16) {
+	p := r.PendingResolves[id]
+	if p == nil {
+		return
 	}
 
-	if err := unix.Sendto(FD, dnsQuery, 0, dnsResolverAddr); err != nil {
-		return 0, err
+	if r.DNSServerIndex == p.ServerIndex {
+		r.DNSServerIndex = (p.ServerIndex + 1) % len(resolvers)
+	}
+	p.ServerIndex = (p.ServerIndex + 1) % len(resolvers)
+	p.Tries++
+	if sendToNextAvailable(r, id, p) == nil {
+		return
 	}
 
-	pendingResolves[id] = p
-	return id, nil
+	delete(r.PendingResolves, id)
+	failed(r, p)
 }
 
-func HandleDNSRead() {
+func HandleDNSRead(r *data.Reactor, fd int) {
 	dnsBuffer := make([]byte, dnsBufferSize)
 	for {
-		n, _, err := unix.Recvfrom(FD, dnsBuffer, 0)
+		n, from, err := unix.Recvfrom(fd, dnsBuffer, 0)
 		if err != nil {
 			if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EWOULDBLOCK) {
 				return
@@ -232,41 +222,55 @@ func HandleDNSRead() {
 			fmt.Printf("dns recvfrom: %v\n", err)
 			return
 		}
-		if n == 0 {
-			return
-		}
-
-		id, ipStr, err := parseDNSResponse(dnsBuffer[:n], false)
-		if err != nil {
-			pendingRequest := pendingResolves[id]
-			if pendingRequest != nil {
-				id, ipStr, err = parseDNSResponse(dnsBuffer[:n], pendingRequest.IsIPv6)
-			}
-
-			if err != nil {
-				fmt.Printf("dns parse err: %v\n", err)
-				continue
-			}
+		if n < dnsHeaderSize {
+			continue
 		}
 
-		pendingRequest := pendingResolves[id]
-		if pendingRequest == nil {
+		id := binary.BigEndian.Uint16(dnsBuffer[dnsIDOffset : dnsIDOffset+2])
+		pendingRequest := r.PendingResolves[id]
+		if pendingRequest == nil || !sameResolver(from, resolvers[pendingRequest.ServerIndex]) {
 			continue
 		}
-		delete(pendingResolves, id)
+		delete(r.PendingResolves, id)
+		r.Timers.Stop(pendingRequest.Timer)
 
-		ip := net.ParseIP(ipStr)
-		if ip == nil {
-			utils.SendSocksReply(pendingRequest.Conn, data.RepGeneralFailure, data.AtypDomain, nil, 0)
-			utils.CloseConn(pendingRequest.Conn)
+		_, ips, ttl, err := parseDNSResponse(dnsBuffer[:n], pendingRequest.IsIPv6)
+		if errors.Is(err, errTruncated) {
+			startTCPQuery(r, pendingRequest)
 			continue
 		}
-		isIPv6 := pendingRequest.IsIPv6
+		handleAnswer(r, pendingRequest, ips, ttl, err)
+	}
+}
 
-		if !connect.StartUpstreamConnect(pendingRequest.Conn, ipStr, pendingRequest.Port, isIPv6) {
-			utils.CloseConn(pendingRequest.Conn)
-			continue
+func handleAnswer(r *data.Reactor, p *data.PendingResolve, ips []net.IP, ttl uint32, err error) {
+	r.Stats.DNSLatency.Observe(time.Since(p.SentAt).Seconds())
+	if err == nil || errors.Is(err, errNXDomain) || errors.Is(err, errNoRecord) {
+		storeCache(p.Domain, p.IsIPv6, ips, time.Duration(ttl)*time.Second)
+	} else {
+		r.Stats.DNSFailures++
+	}
+	resolved(r, p, ips)
+}
+
+// failed finishes a query that got no answer at all.
+func failed(r *data.Reactor, p *data.PendingResolve) {
+	r.Stats.DNSFailures++
+	resolved(r, p, nil)
+}
+
+func resolved(r *data.Reactor, p *data.PendingResolve, ips []net.IP) {
+	if p.OnResolved != nil {
+		if len(ips) > 0 {
+			p.OnResolved(ips[0].String())
 		}
-		pendingRequest.Conn.State = data.StateConnecting
+		return
 	}
+	connect.AddRaceAddresses(r, p.Conn, ips, p.IsIPv6)
+}
+
+func sameResolver(from unix.Sockaddr, resolver unix.Sockaddr) bool {
+	fromIP, fromPort := utils.SockaddrToIP(from)
+	resolverIP, resolverPort := utils.SockaddrToIP(resolver)
+	return fromPort == resolverPort && fromIP.Equal(resolverIP)
 }
@@ -0,0 +1,241 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	maxNameLength   = 255
+	maxPointerJumps = 64
+	maxCNAMEChain   = 8
+
+	dnsTypeCNAME uint16 = 5
+	dnsTCMask           = 0x0200
+)
+
+var (
+	errNXDomain  = errors.New("nxdomain")
+	errNoRecord  = errors.New("no record found")
+	errTruncated = errors.New("truncated response")
+)
+
+type dnsRecord struct {
+	name        string
+	typ         uint16
+	class       uint16
+	ttl         uint32
+	rdata       []byte
+	rdataOffset int
+}
+
+type dnsMessage struct {
+	id        uint16
+	flags     uint16
+	question  string
+	answers   []dnsRecord
+	authority []dnsRecord
+}
+
+// parseMessage decodes the header, the question and the answer and authority sections of an RFC 1035 message.
+func parseMessage(msg []byte) (*dnsMessage, error) {
+	if len(msg) < dnsHeaderSize {
+		return nil, fmt.Errorf("short dns response")
+	}
+	m := &dnsMessage{
+		id:    binary.BigEndian.Uint16(msg[dnsIDOffset : dnsIDOffset+2]),
+		flags: binary.BigEndian.Uint16(msg[dnsFlagsOffset : dnsFlagsOffset+2]),
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[dnsQDCountOffset : dnsQDCountOffset+2]))
+	ancount := int(binary.BigEndian.Uint16(msg[dnsANCountOffset : dnsANCountOffset+2]))
+	nscount := int(binary.BigEndian.Uint16(msg[dnsNSCountOffset : dnsNSCountOffset+2]))
+
+	offset := dnsHeaderSize
+	for i := 0; i < qdcount; i++ {
+		name, next, err := readName(msg, offset)
+		if err != nil {
+			return m, err
+		}
+		if next+dnsTypeClassSize > len(msg) {
+			return m, fmt.Errorf("short question")
+		}
+		if i == 0 {
+			m.question = name
+		}
+		offset = next + dnsTypeClassSize
+	}
+
+	var err error
+	if m.answers, offset, err = readRecords(msg, offset, ancount); err != nil {
+		return m, err
+	}
+	if m.authority, _, err = readRecords(msg, offset, nscount); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+func readRecords(msg []byte, offset int, count int) ([]dnsRecord, int, error) {
+	records := make([]dnsRecord, 0, count)
+	for i := 0; i < count; i++ {
+		name, next, err := readName(msg, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset = next
+		if offset+dnsAnswerMinSize > len(msg) {
+			return nil, 0, fmt.Errorf("short answer")
+		}
+		rec := dnsRecord{
+			name:  name,
+			typ:   binary.BigEndian.Uint16(msg[offset : offset+2]),
+			class: binary.BigEndian.Uint16(msg[offset+2 : offset+4]),
+			ttl:   binary.BigEndian.Uint32(msg[offset+4 : offset+4+dnsTTLSize]),
+		}
+		rdlen := int(binary.BigEndian.Uint16(msg[offset+8 : offset+10]))
+		offset += dnsAnswerMinSize
+		if offset+rdlen > len(msg) {
+			return nil, 0, fmt.Errorf("rdata out of bounds")
+		}
+		rec.rdata = msg[offset : offset+rdlen]
+		rec.rdataOffset = offset
+		offset += rdlen
+		records = append(records, rec)
+	}
+	return records, offset, nil
+}
+
+// readName decompresses a domain name starting at offset and returns it in lower case together
+// with the offset right after the name in the original position. Pointers may only point backwards
+// and are limited in number, so malicious loops are rejected.
+func readName(msg []byte, offset int) (string, int, error) {
+	var name strings.Builder
+	next := -1
+	jumps := 0
+	for {
+		if offset >= len(msg) {
+			return "", 0, fmt.Errorf("uncorrect name")
+		}
+		labelLength := int(msg[offset])
+		switch {
+		case labelLength == 0:
+			if next < 0 {
+				next = offset + 1
+			}
+			return strings.ToLower(name.String()), next, nil
+
+		case labelLength&dnsPointerMask == dnsPointerMask:
+			if offset+1 >= len(msg) {
+				return "", 0, fmt.Errorf("uncorrect name pointer")
+			}
+			target := int(binary.BigEndian.Uint16(msg[offset:offset+2]) & 0x3FFF)
+			if target >= offset || jumps >= maxPointerJumps {
+				return "", 0, fmt.Errorf("name pointer loop")
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			jumps++
+			offset = target
+
+		case labelLength&dnsPointerMask != 0:
+			return "", 0, fmt.Errorf("unsupported label type")
+
+		default:
+			offset++
+			if offset+labelLength > len(msg) {
+				return "", 0, fmt.Errorf("uncorrect name")
+			}
+			if name.Len() > 0 {
+				name.WriteByte('.')
+			}
+			name.Write(msg[offset : offset+labelLength])
+			if name.Len() > maxNameLength {
+				return "", 0, fmt.Errorf("name too long")
+			}
+			offset += labelLength
+		}
+	}
+}
+
+// parseDNSResponse returns the addresses for the queried name, following CNAME records inside the
+// answer section, with the smallest TTL along the chain. For NXDOMAIN and empty answers it returns
+// errNXDomain/errNoRecord with the RFC 2308 negative TTL (0 when there is no SOA).
+func parseDNSResponse(dnsResponse []byte, isIPv6 bool) (uint16, []net.IP, uint32, error) {
+	m, err := parseMessage(dnsResponse)
+	if m == nil {
+		return 0, nil, 0, err
+	}
+	if (m.flags&dnsQRMask)>>15 != dnsQRResponse {
+		return m.id, nil, 0, fmt.Errorf("not a response")
+	}
+	if m.flags&dnsTCMask != 0 {
+		return m.id, nil, 0, errTruncated
+	}
+	if err != nil {
+		return m.id, nil, 0, err
+	}
+
+	rcode := m.flags & dnsRcodeMask
+	if rcode != 0 && rcode != dnsRcodeNXDomain {
+		return m.id, nil, 0, fmt.Errorf("rcode=%d", rcode)
+	}
+
+	var negativeTTL uint32
+	for _, rec := range m.authority {
+		if rec.typ == dnsTypeSOA && len(rec.rdata) >= dnsSOAMinimumSize {
+			negativeTTL = min(rec.ttl, binary.BigEndian.Uint32(rec.rdata[len(rec.rdata)-dnsSOAMinimumSize:]))
+		}
+	}
+	if rcode == dnsRcodeNXDomain {
+		return m.id, nil, negativeTTL, errNXDomain
+	}
+
+	expectedType, expectedSize := dnsTypeA, dnsIPv4Size
+	if isIPv6 {
+		expectedType, expectedSize = dnsTypeAAAA, dnsIPv6Size
+	}
+
+	target := m.question
+	var chainTTL uint32
+	chainStarted := false
+	for hops := 0; hops <= maxCNAMEChain; hops++ {
+		var ips []net.IP
+		minTTL := chainTTL
+		var cname *dnsRecord
+		for i := range m.answers {
+			rec := &m.answers[i]
+			if rec.class != dnsClassIN || rec.name != target {
+				continue
+			}
+			if rec.typ == expectedType && len(rec.rdata) == expectedSize {
+				ips = append(ips, append(net.IP(nil), rec.rdata...))
+				if (!chainStarted && len(ips) == 1) || rec.ttl < minTTL {
+					minTTL = rec.ttl
+				}
+			} else if rec.typ == dnsTypeCNAME && cname == nil {
+				cname = rec
+			}
+		}
+		if len(ips) > 0 {
+			return m.id, ips, minTTL, nil
+		}
+		if cname == nil {
+			break
+		}
+
+		next, _, err := readName(dnsResponse, cname.rdataOffset)
+		if err != nil {
+			return m.id, nil, 0, err
+		}
+		if !chainStarted || cname.ttl < chainTTL {
+			chainTTL = cname.ttl
+		}
+		chainStarted = true
+		target = next
+	}
+	return m.id, nil, negativeTTL, errNoRecord
+}
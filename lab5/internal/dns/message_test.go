@@ -0,0 +1,250 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+const (
+	responseFlags = 0x8180 // QR=1, RD=1, RA=1
+	questionName  = 0xC00C // pointer to the name of the first question
+)
+
+func encodeName(name string) []byte {
+	var encoded []byte
+	for _, label := range strings.Split(name, ".") {
+		encoded = append(encoded, byte(len(label)))
+		encoded = append(encoded, label...)
+	}
+	return append(encoded, 0)
+}
+
+func pointer(offset int) []byte {
+	return binary.BigEndian.AppendUint16(nil, uint16(0xC000|offset))
+}
+
+func record(name []byte, typ uint16, ttl uint32, rdata []byte) []byte {
+	rr := append([]byte(nil), name...)
+	rr = binary.BigEndian.AppendUint16(rr, typ)
+	rr = binary.BigEndian.AppendUint16(rr, dnsClassIN)
+	rr = binary.BigEndian.AppendUint32(rr, ttl)
+	rr = binary.BigEndian.AppendUint16(rr, uint16(len(rdata)))
+	return append(rr, rdata...)
+}
+
+// response builds a message answering an A or AAAA question for name.
+func response(flags uint16, name string, qtype uint16, answers [][]byte, authority [][]byte) []byte {
+	msg := binary.BigEndian.AppendUint16(nil, 0x1234)
+	msg = binary.BigEndian.AppendUint16(msg, flags)
+	msg = binary.BigEndian.AppendUint16(msg, 1)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(answers)))
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(authority)))
+	msg = binary.BigEndian.AppendUint16(msg, 0)
+	msg = append(msg, encodeName(name)...)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+	for _, rr := range append(answers, authority...) {
+		msg = append(msg, rr...)
+	}
+	return msg
+}
+
+func TestReadName(t *testing.T) {
+	header := make([]byte, dnsHeaderSize)
+	example := append(append([]byte(nil), header...), encodeName("Example.COM")...)
+	tests := []struct {
+		name   string
+		msg    []byte
+		offset int
+		want   string
+		next   int
+		fails  bool
+	}{
+		{name: "plain", msg: example, offset: 12, want: "example.com", next: len(example)},
+		{
+			name:   "compressed suffix",
+			msg:    append(append(append([]byte(nil), example...), 4, 'm', 'a', 'i', 'l'), pointer(12)...),
+			offset: len(example), want: "mail.example.com", next: len(example) + 7,
+		},
+		{name: "root", msg: append(append([]byte(nil), header...), 0), offset: 12, want: "", next: 13},
+		{name: "forward pointer", msg: append(append(append([]byte(nil), header...), pointer(14)...), encodeName("a")...), offset: 12, fails: true},
+		{name: "pointer to itself", msg: append(append([]byte(nil), header...), pointer(12)...), offset: 12, fails: true},
+		{
+			name:   "pointer loop",
+			msg:    append(append(append([]byte(nil), header...), 1, 'a'), pointer(12)...),
+			offset: 12, fails: true,
+		},
+		{name: "truncated label", msg: append(append([]byte(nil), header...), 10, 'a', 'b', 'c'), offset: 12, fails: true},
+		{name: "missing terminator", msg: append(append([]byte(nil), header...), 1, 'a'), offset: 12, fails: true},
+		{name: "truncated pointer", msg: append(append([]byte(nil), header...), 0xC0), offset: 12, fails: true},
+		{name: "reserved label type", msg: append(append([]byte(nil), header...), 0x41, 'a', 0), offset: 12, fails: true},
+		{
+			name:   "too long",
+			msg:    append(append([]byte(nil), header...), encodeName(strings.Repeat(strings.Repeat("a", 63)+".", 4)+"a")...),
+			offset: 12, fails: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, next, err := readName(tt.msg, tt.offset)
+			if tt.fails {
+				if err == nil {
+					t.Fatalf("readName() = %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readName(): %v", err)
+			}
+			if got != tt.want || next != tt.next {
+				t.Errorf("readName() = %q, %d; want %q, %d", got, next, tt.want, tt.next)
+			}
+		})
+	}
+}
+
+func TestParseDNSResponse(t *testing.T) {
+	ipv4 := net.IPv4(192, 0, 2, 1).To4()
+	ipv6 := net.ParseIP("2001:db8::1")
+	soa := append(append(encodeName("ns.example.com"), encodeName("admin.example.com")...), make([]byte, 16)...)
+	soa = binary.BigEndian.AppendUint32(soa, 60) // MINIMUM
+
+	tests := []struct {
+		name   string
+		msg    []byte
+		isIPv6 bool
+		ips    []net.IP
+		ttl    uint32
+		err    error
+	}{
+		{
+			name: "a record",
+			msg:  response(responseFlags, "example.com", dnsTypeA, [][]byte{record(pointer(12), dnsTypeA, 300, ipv4)}, nil),
+			ips:  []net.IP{ipv4}, ttl: 300,
+		},
+		{
+			name: "smallest ttl of several records",
+			msg: response(responseFlags, "example.com", dnsTypeA, [][]byte{
+				record(pointer(12), dnsTypeA, 300, ipv4),
+				record(pointer(12), dnsTypeA, 30, net.IPv4(192, 0, 2, 2).To4()),
+			}, nil),
+			ips: []net.IP{ipv4, net.IPv4(192, 0, 2, 2).To4()}, ttl: 30,
+		},
+		{
+			name:   "aaaa ignores a records",
+			msg:    response(responseFlags, "example.com", dnsTypeAAAA, [][]byte{record(pointer(12), dnsTypeA, 300, ipv4), record(pointer(12), dnsTypeAAAA, 300, ipv6)}, nil),
+			isIPv6: true,
+			ips:    []net.IP{ipv6}, ttl: 300,
+		},
+		{
+			name: "answer name in another case",
+			msg:  response(responseFlags, "example.com", dnsTypeA, [][]byte{record(encodeName("EXAMPLE.com"), dnsTypeA, 300, ipv4)}, nil),
+			ips:  []net.IP{ipv4}, ttl: 300,
+		},
+		{
+			name: "cname chain",
+			msg: response(responseFlags, "www.example.com", dnsTypeA, [][]byte{
+				record(pointer(12), dnsTypeCNAME, 300, encodeName("cdn.example.net")),
+				record(encodeName("cdn.example.net"), dnsTypeCNAME, 60, encodeName("edge.example.net")),
+				record(encodeName("edge.example.net"), dnsTypeA, 120, ipv4),
+			}, nil),
+			ips: []net.IP{ipv4}, ttl: 60,
+		},
+		{
+			name: "cname target compressed",
+			msg: response(responseFlags, "www.example.com", dnsTypeA, [][]byte{
+				record(pointer(12), dnsTypeCNAME, 300, append([]byte{4, 'e', 'd', 'g', 'e'}, pointer(16)...)),
+				record(encodeName("edge.example.com"), dnsTypeA, 120, ipv4),
+			}, nil),
+			ips: []net.IP{ipv4}, ttl: 120,
+		},
+		{
+			name: "cname without address",
+			msg:  response(responseFlags, "www.example.com", dnsTypeA, [][]byte{record(pointer(12), dnsTypeCNAME, 300, encodeName("cdn.example.net"))}, nil),
+			err:  errNoRecord,
+		},
+		{
+			name: "cname loop",
+			msg: response(responseFlags, "a.example.com", dnsTypeA, [][]byte{
+				record(pointer(12), dnsTypeCNAME, 300, encodeName("b.example.com")),
+				record(encodeName("b.example.com"), dnsTypeCNAME, 300, encodeName("a.example.com")),
+			}, nil),
+			err: errNoRecord,
+		},
+		{
+			name: "truncated",
+			msg:  response(responseFlags|dnsTCMask, "example.com", dnsTypeA, nil, nil),
+			err:  errTruncated,
+		},
+		{
+			name: "truncated with a cut record",
+			msg:  response(responseFlags|dnsTCMask, "example.com", dnsTypeA, [][]byte{record(pointer(12), dnsTypeA, 300, ipv4)[:8]}, nil),
+			err:  errTruncated,
+		},
+		{
+			name: "nxdomain with soa",
+			msg:  response(responseFlags|dnsRcodeNXDomain, "missing.example.com", dnsTypeA, nil, [][]byte{record(encodeName("example.com"), dnsTypeSOA, 900, soa)}),
+			ttl:  60, err: errNXDomain,
+		},
+		{
+			name: "nxdomain without soa",
+			msg:  response(responseFlags|dnsRcodeNXDomain, "missing.example.com", dnsTypeA, nil, nil),
+			err:  errNXDomain,
+		},
+		{
+			name: "empty answer",
+			msg:  response(responseFlags, "example.com", dnsTypeA, nil, [][]byte{record(encodeName("example.com"), dnsTypeSOA, 30, soa)}),
+			ttl:  30, err: errNoRecord,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, ips, ttl, err := parseDNSResponse(tt.msg, tt.isIPv6)
+			if id != 0x1234 {
+				t.Errorf("id = %#x", id)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v; want %v", err, tt.err)
+			}
+			if ttl != tt.ttl {
+				t.Errorf("ttl = %d; want %d", ttl, tt.ttl)
+			}
+			if len(ips) != len(tt.ips) {
+				t.Fatalf("ips = %v; want %v", ips, tt.ips)
+			}
+			for i := range ips {
+				if !ips[i].Equal(tt.ips[i]) {
+					t.Errorf("ips = %v; want %v", ips, tt.ips)
+				}
+			}
+		})
+	}
+}
+
+func TestParseDNSResponseRejects(t *testing.T) {
+	ipv4 := net.IPv4(192, 0, 2, 1).To4()
+	valid := response(responseFlags, "example.com", dnsTypeA, [][]byte{record(pointer(12), dnsTypeA, 300, ipv4)}, nil)
+	query := append([]byte(nil), valid...)
+	binary.BigEndian.PutUint16(query[dnsFlagsOffset:], 0x0100)
+	servfail := append([]byte(nil), valid...)
+	binary.BigEndian.PutUint16(servfail[dnsFlagsOffset:], responseFlags|2)
+
+	for name, msg := range map[string][]byte{
+		"short header":   valid[:dnsHeaderSize-1],
+		"cut answer":     valid[:len(valid)-2],
+		"cut question":   valid[:dnsHeaderSize+5],
+		"not a response": query,
+		"servfail":       servfail,
+		"forward pointer in answer": response(responseFlags, "example.com", dnsTypeA,
+			[][]byte{record(pointer(200), dnsTypeA, 300, ipv4)}, nil),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, ips, _, err := parseDNSResponse(msg, false); err == nil {
+				t.Errorf("parseDNSResponse() = %v, want an error", ips)
+			}
+		})
+	}
+}
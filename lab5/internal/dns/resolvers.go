@@ -0,0 +1,145 @@
+package dns
+
+import (
+	"bufio"
+	"fmt"
+	"lab5/internal/data"
+	"lab5/internal/utils"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	resolvConfPath  = "/etc/resolv.conf"
+	defaultResolver = "127.0.0.1"
+	dnsPort         = 53
+)
+
+var resolvers []unix.Sockaddr
+
+// ConfigureResolvers takes a comma-separated list of resolvers ("1.1.1.1", "10.0.0.2:5353",
+// "[2001:db8::1]:53"); an empty list means the nameservers from /etc/resolv.conf.
+func ConfigureResolvers(list string) error {
+	var addrs []string
+	if list != "" {
+		addrs = strings.Split(list, ",")
+	} else {
+		var err error
+		addrs, err = readResolvConf(resolvConfPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if len(addrs) == 0 {
+		addrs = []string{defaultResolver}
+	}
+
+	resolvers = resolvers[:0]
+	for _, addr := range addrs {
+		sa, err := parseResolverAddr(strings.TrimSpace(addr))
+		if err != nil {
+			return err
+		}
+		resolvers = append(resolvers, sa)
+	}
+	return nil
+}
+
+func Resolvers() []string {
+	list := make([]string, 0, len(resolvers))
+	for _, sa := range resolvers {
+		ip, port := utils.SockaddrToIP(sa)
+		list = append(list, net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	}
+	return list
+}
+
+// OpenSockets creates one UDP socket per address family that has a configured resolver.
+func OpenSockets(r *data.Reactor) error {
+	for _, sa := range resolvers {
+		var err error
+		if _, isIPv6 := sa.(*unix.SockaddrInet6); isIPv6 {
+			if r.DNSFD6 < 0 {
+				r.DNSFD6, err = openSocket(r, unix.AF_INET6)
+			}
+		} else if r.DNSFD < 0 {
+			r.DNSFD, err = openSocket(r, unix.AF_INET)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func openSocket(r *data.Reactor, family int) (int, error) {
+	fd, err := unix.Socket(family, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		return -1, fmt.Errorf("dns socket faile: %v", err)
+	}
+	if err := unix.SetNonblock(fd, true); err != nil {
+		_ = unix.Close(fd)
+		return -1, fmt.Errorf("dns setnonblock faile: %v", err)
+	}
+	if err := utils.EpollAdd(r, fd, unix.EPOLLIN); err != nil {
+		_ = unix.Close(fd)
+		return -1, fmt.Errorf("epoll add dns faile: %v", err)
+	}
+	return fd, nil
+}
+
+func readResolvConf(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+
+	var nameservers []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			nameservers = append(nameservers, fields[1])
+		}
+	}
+	return nameservers, scanner.Err()
+}
+
+func parseResolverAddr(addr string) (unix.Sockaddr, error) {
+	host, port := addr, dnsPort
+	if h, p, err := net.SplitHostPort(addr); err == nil {
+		host = h
+		port, err = strconv.Atoi(p)
+		if err != nil || port <= 0 || port > 0xFFFF {
+			return nil, fmt.Errorf("invalid resolver port in %q", addr)
+		}
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+
+	ipStr, zone, _ := strings.Cut(host, "%")
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid resolver address %q", addr)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		sa4 := &unix.SockaddrInet4{Port: port}
+		copy(sa4.Addr[:], ip4)
+		return sa4, nil
+	}
+
+	sa6 := &unix.SockaddrInet6{Port: port}
+	copy(sa6.Addr[:], ip.To16())
+	if zone != "" {
+		iface, err := net.InterfaceByName(zone)
+		if err != nil {
+			return nil, fmt.Errorf("resolver %q: %v", addr, err)
+		}
+		sa6.ZoneId = uint32(iface.Index)
+	}
+	return sa6, nil
+}
@@ -0,0 +1,117 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"lab5/internal/data"
+	"lab5/internal/utils"
+
+	"golang.org/x/sys/unix"
+)
+
+const tcpLengthPrefixSize = 2
+
+// startTCPQuery repeats a query whose UDP answer had the TC bit set over TCP to the same resolver (RFC 7766).
+func startTCPQuery(r *data.Reactor, p *data.PendingResolve) {
+	sa := resolvers[p.ServerIndex]
+	family := unix.AF_INET
+	if _, isIPv6 := sa.(*unix.SockaddrInet6); isIPv6 {
+		family = unix.AF_INET6
+	}
+
+	fd, err := unix.Socket(family, unix.SOCK_STREAM, 0)
+	if err != nil {
+		failed(r, p)
+		return
+	}
+	p.TCPFD = fd
+	p.TCPOut = binary.BigEndian.AppendUint16(nil, uint16(len(p.Query)))
+	p.TCPOut = append(p.TCPOut, p.Query...)
+	p.TCPIn = nil
+	r.FdsInfo[fd] = &data.FDInfo{Resolve: p}
+
+	if err = unix.SetNonblock(fd, true); err != nil {
+		finishTCPQuery(r, p, nil)
+		return
+	}
+	if err = unix.Connect(fd, sa); err != nil && !errors.Is(err, unix.EINPROGRESS) {
+		finishTCPQuery(r, p, nil)
+		return
+	}
+	if err = utils.EpollAdd(r, fd, unix.EPOLLOUT); err != nil {
+		finishTCPQuery(r, p, nil)
+		return
+	}
+	p.Timer = r.Timers.Add(QueryTimeout, func() {
+		p.Timer = nil
+		finishTCPQuery(r, p, nil)
+	})
+}
+
+func HandleTCP(r *data.Reactor, p *data.PendingResolve, events uint32) {
+	fd := p.TCPFD
+	if events&unix.EPOLLERR != 0 {
+		finishTCPQuery(r, p, nil)
+		return
+	}
+
+	if events&unix.EPOLLOUT != 0 && len(p.TCPOut) > 0 {
+		n, err := unix.Write(fd, p.TCPOut)
+		if err != nil {
+			if !errors.Is(err, unix.EAGAIN) {
+				finishTCPQuery(r, p, nil)
+			}
+			return
+		}
+		p.TCPOut = p.TCPOut[n:]
+		if len(p.TCPOut) == 0 {
+			_ = utils.EpollMod(r, fd, unix.EPOLLIN)
+		}
+	}
+
+	if events&(unix.EPOLLIN|unix.EPOLLHUP) == 0 {
+		return
+	}
+	readBuffer := make([]byte, dnsBufferSize)
+	for {
+		n, err := unix.Read(fd, readBuffer)
+		if n > 0 {
+			p.TCPIn = append(p.TCPIn, readBuffer[:n]...)
+		}
+		if len(p.TCPIn) >= tcpLengthPrefixSize {
+			msgLen := int(binary.BigEndian.Uint16(p.TCPIn))
+			if len(p.TCPIn) >= tcpLengthPrefixSize+msgLen {
+				finishTCPQuery(r, p, p.TCPIn[tcpLengthPrefixSize:tcpLengthPrefixSize+msgLen])
+				return
+			}
+		}
+		if err != nil {
+			if !errors.Is(err, unix.EAGAIN) {
+				finishTCPQuery(r, p, nil)
+			}
+			return
+		}
+		if n == 0 {
+			finishTCPQuery(r, p, nil)
+			return
+		}
+	}
+}
+
+func finishTCPQuery(r *data.Reactor, p *data.PendingResolve, msg []byte) {
+	if p.TCPFD < 0 {
+		return
+	}
+	utils.CloseResolveTCP(r, p)
+
+	if msg == nil {
+		failed(r, p)
+		return
+	}
+	id, ips, ttl, err := parseDNSResponse(msg, p.IsIPv6)
+	if id != p.ID {
+		failed(r, p)
+		return
+	}
+	handleAnswer(r, p, ips, ttl, err)
+}
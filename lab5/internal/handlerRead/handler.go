@@ -2,72 +2,114 @@ package handlerRead
 
 import (
 	"errors"
+	"lab5/internal/chain"
 	"lab5/internal/client"
 	"lab5/internal/data"
+	"lab5/internal/handlerWrite"
 	"lab5/internal/handshake"
 	"lab5/internal/upStream"
 	"lab5/internal/utils"
-	"log"
 
 	"golang.org/x/sys/unix"
 )
 
-func Client(conn *data.Conn) {
+func Client(r *data.Reactor, conn *data.Conn) {
+	if conn.ClientToUpstreamPipe != nil && conn.ClientToUpstreamBuffer.Len() == 0 && spliceClient(r, conn) {
+		return
+	}
 	fd := conn.ClientFD
-	clientBuffer := make([]byte, data.HandlerBufferSize)
+	clientBuffer := r.ReadBuffer[:data.HandlerBufferSize]
 	for {
-		n, err := unix.Read(fd, clientBuffer)
+		limit := utils.ReadAllowance(r, conn, true, len(clientBuffer))
+		if limit == 0 {
+			return
+		}
+		n, err := unix.Read(fd, clientBuffer[:limit])
 		if n > 0 {
-			totalBufferSize := conn.ClientToUpstreamBuffer.Len() + n
-
-			if totalBufferSize > data.MaxBufferSizeForClient {
-				log.Printf("Buffer overflow, closing connection: clientFD=%d", conn.ClientFD)
-				utils.CloseConn(conn)
-				return
-			}
-
-			if conn.State == data.StateGreeting || conn.State == data.StateRequest {
+			utils.Touch(conn)
+			if conn.State == data.StateGreeting || conn.State == data.StateAuth || conn.State == data.StateRequest {
 				conn.HandshakeBuffer.Write(clientBuffer[:n])
-				handshake.TryProcessHandshake(conn)
-			} else {
+				handshake.TryProcessHandshake(r, conn)
+				if conn.AuthPending {
+					return
+				}
+			} else if conn.State != data.StateUDPAssociated {
+				utils.CountRelayed(r, conn, n, true)
 				conn.ClientToUpstreamBuffer.Write(clientBuffer[:n])
-				upStream.FlushUpstreamWrites(conn)
+				upStream.FlushUpstreamWrites(r, conn)
+				if conn.ClientToUpstreamBuffer.Len() >= data.BufferHighWatermark {
+					utils.UpdateClientEvents(r, conn)
+					return
+				}
 			}
 		}
 		if err != nil {
 			if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EWOULDBLOCK) {
+				conn.ClientReadable = false
 				return
 			}
-			utils.CloseConn(conn)
+			utils.CloseConn(r, conn)
 			return
 		}
 		if n == 0 {
+			// A handshake cut short can never complete, and it would hold its connection slot.
+			if conn.State == data.StateUDPAssociated || conn.State == data.StateGreeting ||
+				conn.State == data.StateAuth || conn.State == data.StateRequest {
+				utils.CloseConn(r, conn)
+				return
+			}
 			conn.ClientClosed = true
 			if conn.UpstreamFD >= 0 && conn.ClientToUpstreamBuffer.Len() == 0 {
 				_ = unix.Shutdown(conn.UpstreamFD, unix.SHUT_WR)
 			}
+			utils.UpdateClientEvents(r, conn)
 			return
 		}
 	}
 }
 
-func Upstream(conn *data.Conn) {
+func Upstream(r *data.Reactor, conn *data.Conn) {
 	fd := conn.UpstreamFD
 	if fd < 0 {
 		return
 	}
-	upStreamBuffer := make([]byte, data.HandlerBufferSize)
+	if conn.State == data.StateChaining {
+		if rest, ready := chain.Read(r, conn); ready {
+			handlerWrite.StartRelaying(r, conn)
+			if len(rest) > 0 && conn.ClientFD >= 0 {
+				utils.CountRelayed(r, conn, len(rest), false)
+				conn.UpstreamToClientBuffer.Write(rest)
+				client.FlushClientWrites(r, conn)
+			}
+		}
+		return
+	}
+	if conn.UpstreamToClientPipe != nil && conn.UpstreamToClientBuffer.Len() == 0 && spliceUpstream(r, conn) {
+		return
+	}
+	upStreamBuffer := r.ReadBuffer[:data.HandlerBufferSize]
 	for {
-		n, err := unix.Read(fd, upStreamBuffer)
+		limit := utils.ReadAllowance(r, conn, false, len(upStreamBuffer))
+		if limit == 0 {
+			return
+		}
+		n, err := unix.Read(fd, upStreamBuffer[:limit])
 		if n > 0 {
+			utils.Touch(conn)
+			utils.CountRelayed(r, conn, n, false)
 			conn.UpstreamToClientBuffer.Write(upStreamBuffer[:n])
-			client.FlushClientWrites(conn)
+			client.FlushClientWrites(r, conn)
+			if conn.UpstreamToClientBuffer.Len() >= data.BufferHighWatermark {
+				utils.UpdateUpstreamEvents(r, conn)
+				return
+			}
 		}
 		if err != nil {
 			if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EWOULDBLOCK) {
+				conn.UpstreamReadable = false
 				return
 			}
-			utils.CloseConn(conn)
+			utils.CloseConn(r, conn)
 			return
 		}
 		if n == 0 {
@@ -75,7 +117,43 @@ func Upstream(conn *data.Conn) {
 			if conn.UpstreamToClientBuffer.Len() == 0 {
 				_ = unix.Shutdown(conn.ClientFD, unix.SHUT_WR)
 			}
+			utils.UpdateUpstreamEvents(r, conn)
 			return
 		}
 	}
 }
+
+// Hangup handles EPOLLHUP: both directions of the socket are shut down, but data that arrived
+// before the FIN may still be queued and has to reach the other side before the session closes.
+func Hangup(r *data.Reactor, conn *data.Conn, isClient bool) {
+	if conn.State != data.StateRelaying {
+		utils.CloseConn(r, conn)
+		return
+	}
+	// Read until EOF or until flow control or shaping pauses the socket; only then can it leave epoll safely.
+	for conn.ClientFD >= 0 {
+		if isClient && !conn.ClientClosed && !conn.ClientReadPaused && !conn.ClientThrottled {
+			Client(r, conn)
+		} else if !isClient && !conn.UpstreamClosed && !conn.UpstreamReadPaused && !conn.UpstreamThrottled {
+			Upstream(r, conn)
+		} else {
+			break
+		}
+	}
+	if conn.ClientFD < 0 {
+		return
+	}
+
+	clientDone := conn.ClientClosed && conn.ClientToUpstreamBuffer.Len() == 0 && utils.PipePending(conn.ClientToUpstreamPipe) == 0
+	upstreamDone := conn.UpstreamClosed && conn.UpstreamToClientBuffer.Len() == 0 && utils.PipePending(conn.UpstreamToClientPipe) == 0
+	if clientDone && upstreamDone {
+		utils.CloseConn(r, conn)
+		return
+	}
+	// HUP is level-triggered and cannot be masked, so the socket leaves epoll until flow control re-adds it.
+	if isClient {
+		utils.EpollDel(r, conn.ClientFD)
+	} else {
+		utils.EpollDel(r, conn.UpstreamFD)
+	}
+}
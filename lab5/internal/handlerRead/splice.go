@@ -0,0 +1,55 @@
+package handlerRead
+
+import (
+	"errors"
+	"lab5/internal/client"
+	"lab5/internal/data"
+	"lab5/internal/upStream"
+	"lab5/internal/utils"
+)
+
+// spliceClient relays client data through the kernel pipe; it returns false when splice turned
+// out to be unsupported and the caller should continue on the buffer path.
+func spliceClient(r *data.Reactor, conn *data.Conn) bool {
+	limit := utils.ReadAllowance(r, conn, true, conn.ClientToUpstreamPipe.Size)
+	if limit == 0 {
+		return true
+	}
+	moved, eof, err := utils.SpliceRead(conn, conn.ClientFD, conn.ClientToUpstreamPipe, limit)
+	utils.CountRelayed(r, conn, moved, true)
+	if errors.Is(err, utils.ErrSpliceUnsupported) && utils.StopSplice(conn) {
+		return false
+	}
+	if err != nil {
+		utils.CloseConn(r, conn)
+		return true
+	}
+	if eof {
+		conn.ClientClosed = true
+	}
+	upStream.FlushUpstreamWrites(r, conn)
+	utils.UpdateClientEvents(r, conn)
+	return true
+}
+
+func spliceUpstream(r *data.Reactor, conn *data.Conn) bool {
+	limit := utils.ReadAllowance(r, conn, false, conn.UpstreamToClientPipe.Size)
+	if limit == 0 {
+		return true
+	}
+	moved, eof, err := utils.SpliceRead(conn, conn.UpstreamFD, conn.UpstreamToClientPipe, limit)
+	utils.CountRelayed(r, conn, moved, false)
+	if errors.Is(err, utils.ErrSpliceUnsupported) && utils.StopSplice(conn) {
+		return false
+	}
+	if err != nil {
+		utils.CloseConn(r, conn)
+		return true
+	}
+	if eof {
+		conn.UpstreamClosed = true
+	}
+	client.FlushClientWrites(r, conn)
+	utils.UpdateUpstreamEvents(r, conn)
+	return true
+}
@@ -1,52 +1,77 @@
 package handlerWrite
 
 import (
+	"lab5/internal/chain"
 	"lab5/internal/client"
 	"lab5/internal/data"
+	"lab5/internal/rateLimit"
 	"lab5/internal/upStream"
 	"lab5/internal/utils"
+	"net"
+	"strconv"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
 
-func Client(conn *data.Conn) {
-	client.FlushClientWrites(conn)
+func Client(r *data.Reactor, conn *data.Conn) {
+	client.FlushClientWrites(r, conn)
 }
 
-func Upstream(conn *data.Conn) {
+func Upstream(r *data.Reactor, conn *data.Conn) {
 	upfd := conn.UpstreamFD
 	if upfd < 0 {
 		return
 	}
 	if conn.State == data.StateConnecting {
 		soErr, err := unix.GetsockoptInt(upfd, unix.SOL_SOCKET, unix.SO_ERROR)
-		if err != nil || soErr != 0 {
-			utils.SendSocksReply(conn, data.RepGeneralFailure, data.AtypIPv4, nil, 0)
-			utils.CloseConn(conn)
-			return
+		if err == nil && soErr != 0 {
+			err = unix.Errno(soErr)
 		}
-		sa, err := unix.Getsockname(conn.UpstreamFD)
 		if err != nil {
-			utils.SendSocksReply(conn, data.RepGeneralFailure, data.AtypIPv4, nil, 0)
-			utils.CloseConn(conn)
+			utils.SendSocksReply(r, conn, utils.ReplyForError(err), data.AtypIPv4, nil, 0)
+			utils.CloseConn(r, conn)
 			return
 		}
-		if _, isIPv6 := sa.(*unix.SockaddrInet6); isIPv6 {
-			if !utils.SendSocksReply(conn, data.RepSuccess, data.AtypIPv6, make([]byte, 16), 0) {
-				utils.CloseConn(conn)
-				return
-			}
-		} else {
-			if !utils.SendSocksReply(conn, data.RepSuccess, data.AtypIPv4, []byte{0, 0, 0, 0}, 0) {
-				utils.CloseConn(conn)
-				return
-			}
+		if conn.Chain != nil {
+			chain.Start(r, conn)
+			return
 		}
-		_ = utils.EpollMod(upfd, unix.EPOLLIN)
-		_ = utils.EpollMod(conn.ClientFD, unix.EPOLLIN)
-		conn.State = data.StateRelaying
-		upStream.FlushUpstreamWrites(conn)
+		StartRelaying(r, conn)
+		return
+	}
+	if conn.State == data.StateChaining {
+		chain.Flush(r, conn)
 		return
 	}
-	upStream.FlushUpstreamWrites(conn)
+	upStream.FlushUpstreamWrites(r, conn)
+}
+
+// StartRelaying tells the client the upstream connection is ready and switches it to relaying.
+func StartRelaying(r *data.Reactor, conn *data.Conn) {
+	sa, err := unix.Getsockname(conn.UpstreamFD)
+	if err != nil {
+		utils.SendSocksReply(r, conn, data.RepGeneralFailure, data.AtypIPv4, nil, 0)
+		utils.CloseConn(r, conn)
+		return
+	}
+	boundIP, boundPort := utils.SockaddrToIP(sa)
+	if !utils.SendAddrReply(r, conn, boundIP, boundPort) {
+		utils.CloseConn(r, conn)
+		return
+	}
+	if peer, err := unix.Getpeername(conn.UpstreamFD); err == nil {
+		peerIP, peerPort := utils.SockaddrToIP(peer)
+		conn.Upstream = net.JoinHostPort(peerIP.String(), strconv.Itoa(peerPort))
+	}
+	conn.ConnectedAt = time.Now()
+	conn.Limits = rateLimit.ForConn(conn.ClientIP, conn.Username)
+	r.Stats.ConnectLatency.Observe(conn.ConnectedAt.Sub(conn.RequestAt).Seconds())
+	conn.State = data.StateRelaying
+	utils.StartSplice(conn)
+	utils.StartEdgeTriggered(r, conn)
+	utils.UpdateUpstreamEvents(r, conn)
+	utils.UpdateClientEvents(r, conn)
+	utils.ArmDeadline(r, conn)
+	upStream.FlushUpstreamWrites(r, conn)
 }
@@ -1,13 +1,19 @@
 package handshake
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"lab5/internal/acl"
+	"lab5/internal/auth"
+	"lab5/internal/chain"
 	"lab5/internal/connect"
 	"lab5/internal/data"
 	"lab5/internal/dns"
+	"lab5/internal/udpRelay"
 	"lab5/internal/utils"
 	"net"
+	"time"
 )
 
 const (
@@ -25,19 +31,38 @@ const (
 	addressTypeOffset  = 3
 	domainLenOffset    = 4
 	domainStartOffset  = 5
+
+	authHeaderSize      = 2
+	authVersionOffset   = 0
+	usernameLenOffset   = 1
+	usernameStartOffset = 2
 )
 
-func TryProcessHandshake(conn *data.Conn) {
+func TryProcessHandshake(r *data.Reactor, conn *data.Conn) {
 	for {
+		if conn.AuthPending {
+			return
+		}
 		switch conn.State {
 		case data.StateGreeting:
+			if conn.HandshakeBuffer.Len() == 0 {
+				return
+			}
+			if version := conn.HandshakeBuffer.Bytes()[versionOffset]; version == data.Socks4Ver || isHTTPRequestStart(version) {
+				conn.Protocol = data.ProtocolHTTP
+				if version == data.Socks4Ver {
+					conn.Protocol = data.ProtocolSocks4
+				}
+				conn.State = data.StateRequest
+				continue
+			}
 			if conn.HandshakeBuffer.Len() < greetingHeaderSize {
 				return
 			}
 
 			handshakeBuffer := conn.HandshakeBuffer.Bytes()
 			if handshakeBuffer[versionOffset] != data.SocksVer {
-				utils.CloseConn(conn)
+				utils.CloseConn(r, conn)
 				return
 			}
 
@@ -49,44 +74,104 @@ func TryProcessHandshake(conn *data.Conn) {
 
 			methods := handshakeBuffer[methodsStartOffset : methodsStartOffset+methodsCount]
 
-			noAuthSupported := false
+			wantedMethod := byte(data.SocksMethodNoAuth)
+			if auth.Store != nil {
+				wantedMethod = data.SocksMethodUserPass
+			}
+			methodSupported := false
 			for _, method := range methods {
-				if method == data.SocksMethodNoAuth {
-					noAuthSupported = true
+				if method == wantedMethod {
+					methodSupported = true
 					break
 				}
 			}
 			conn.HandshakeBuffer.Next(greetingHeaderSize + methodsCount)
 
-			if !utils.WriteAll(conn, conn.ClientFD, []byte{data.SocksVer, data.SocksMethodNoAuth}, false) {
-				utils.CloseConn(conn)
+			if !methodSupported {
+				utils.WriteAll(r, conn, conn.ClientFD, []byte{data.SocksVer, data.SocksMethodNoAcceptable}, false)
+				utils.CloseConn(r, conn)
+				return
+			}
+
+			if !utils.WriteAll(r, conn, conn.ClientFD, []byte{data.SocksVer, wantedMethod}, false) {
+				utils.CloseConn(r, conn)
+				return
+			}
+
+			if wantedMethod == data.SocksMethodUserPass {
+				conn.State = data.StateAuth
+			} else {
+				conn.State = data.StateRequest
+			}
+
+		case data.StateAuth:
+			if conn.HandshakeBuffer.Len() < authHeaderSize {
+				return
+			}
+
+			handshakeBuffer := conn.HandshakeBuffer.Bytes()
+			if handshakeBuffer[authVersionOffset] != data.AuthVer {
+				utils.CloseConn(r, conn)
 				return
 			}
 
-			if !noAuthSupported {
-				utils.CloseConn(conn)
+			usernameLen := int(handshakeBuffer[usernameLenOffset])
+			passwordLenOffset := usernameStartOffset + usernameLen
+			if conn.HandshakeBuffer.Len() < passwordLenOffset+1 {
 				return
 			}
 
-			conn.State = data.StateRequest
+			passwordLen := int(handshakeBuffer[passwordLenOffset])
+			passwordStart := passwordLenOffset + 1
+			if conn.HandshakeBuffer.Len() < passwordStart+passwordLen {
+				return
+			}
+
+			username := string(handshakeBuffer[usernameStartOffset:passwordLenOffset])
+			password := string(handshakeBuffer[passwordStart : passwordStart+passwordLen])
+			conn.HandshakeBuffer.Next(passwordStart + passwordLen)
+
+			verifyCredentials(r, conn, username, password, func(ok bool) {
+				if !ok {
+					utils.WriteAll(r, conn, conn.ClientFD, []byte{data.AuthVer, data.AuthStatusFailure}, false)
+					utils.CloseConn(r, conn)
+					return
+				}
+				if !utils.WriteAll(r, conn, conn.ClientFD, []byte{data.AuthVer, data.AuthStatusSuccess}, false) {
+					utils.CloseConn(r, conn)
+					return
+				}
+				conn.Username = username
+				conn.State = data.StateRequest
+				TryProcessHandshake(r, conn)
+			})
+			return
 
 		case data.StateRequest:
+			switch conn.Protocol {
+			case data.ProtocolHTTP:
+				processHTTPRequest(r, conn)
+				return
+			case data.ProtocolSocks4:
+				processSocks4Request(r, conn)
+				return
+			}
 			if conn.HandshakeBuffer.Len() < requestMinSize {
 				return
 			}
 
 			handshakeBuffer := conn.HandshakeBuffer.Bytes()
 			if handshakeBuffer[versionOffset] != data.SocksVer {
-				utils.CloseConn(conn)
+				utils.CloseConn(r, conn)
 				return
 			}
 
 			command := handshakeBuffer[commandOffset]
 			addressType := handshakeBuffer[addressTypeOffset]
 
-			if command != data.SocksCmdConnect {
-				utils.SendSocksReply(conn, data.RepCommandNotSupported, addressType, nil, 0)
-				utils.CloseConn(conn)
+			if command != data.SocksCmdConnect && command != data.SocksCmdBind && command != data.SocksCmdUDPAssociate {
+				utils.SendSocksReply(r, conn, data.RepCommandNotSupported, addressType, nil, 0)
+				utils.CloseConn(r, conn)
 				return
 			}
 			if addressType == data.AtypIPv4 {
@@ -108,12 +193,7 @@ func TryProcessHandshake(conn *data.Conn) {
 				port := int(binary.BigEndian.Uint16(handshakeBuffer[portStart:portEnd]))
 
 				conn.HandshakeBuffer.Next(ipv4RequestSize)
-				if !connect.StartUpstreamConnect(conn, addr, port, false) {
-					utils.CloseConn(conn)
-					return
-				}
-
-				conn.State = data.StateConnecting
+				startCommand(r, conn, command, addressType, addr, port)
 				return
 			}
 
@@ -135,15 +215,7 @@ func TryProcessHandshake(conn *data.Conn) {
 				port := int(binary.BigEndian.Uint16(handshakeBuffer[portStart:portEnd]))
 
 				conn.HandshakeBuffer.Next(domainMinSize + domainLen + portSize)
-
-				pr := &dns.PendingResolve{Conn: conn, Domain: domain, Port: port}
-				_, err := dns.SendDNSQuery(domain, pr)
-				if err != nil {
-					utils.SendSocksReply(conn, data.RepGeneralFailure, data.AtypDomain, nil, 0)
-					utils.CloseConn(conn)
-					return
-				}
-				conn.State = data.StateResolving
+				startCommand(r, conn, command, addressType, domain, port)
 				return
 			}
 
@@ -163,19 +235,117 @@ func TryProcessHandshake(conn *data.Conn) {
 
 				conn.HandshakeBuffer.Next(ipv6RequestSize)
 				addr := net.IP(addrBytes).String()
-				if !connect.StartUpstreamConnect(conn, addr, port, true) {
-					utils.CloseConn(conn)
-					return
-				}
-				conn.State = data.StateConnecting
+				startCommand(r, conn, command, addressType, addr, port)
 				return
 			}
 
-			utils.SendSocksReply(conn, data.RepAddrTypeNotSupported, addressType, nil, 0)
-			utils.CloseConn(conn)
+			utils.SendSocksReply(r, conn, data.RepAddrTypeNotSupported, addressType, nil, 0)
+			utils.CloseConn(r, conn)
 			return
 		default:
 			return
 		}
 	}
 }
+
+func startCommand(r *data.Reactor, conn *data.Conn, command byte, addressType byte, host string, port int) {
+	// Whatever the client pipelined after the request belongs to the relay.
+	conn.ClientToUpstreamBuffer.Write(conn.HandshakeBuffer.Bytes())
+	conn.HandshakeBuffer = bytes.Buffer{}
+	conn.Command, conn.TargetAtyp, conn.TargetHost, conn.TargetPort = command, addressType, host, port
+	conn.RequestAt = time.Now()
+
+	// BIND and UDP ASSOCIATE have no destination yet; their peers are checked as they show up.
+	if !acl.ClientAllowed(conn.ClientIP) {
+		utils.SendSocksReply(r, conn, data.RepConnectionNotAllowed, data.AtypIPv4, nil, 0)
+		utils.CloseConn(r, conn)
+		return
+	}
+
+	if command == data.SocksCmdUDPAssociate {
+		if !udpRelay.StartAssociate(r, conn, host, port) {
+			utils.CloseConn(r, conn)
+			return
+		}
+		conn.State = data.StateUDPAssociated
+		conn.ConnectedAt = time.Now()
+		utils.ArmDeadline(r, conn)
+		return
+	}
+
+	if command == data.SocksCmdBind {
+		if !connect.StartBind(r, conn, host) {
+			utils.CloseConn(r, conn)
+			return
+		}
+		conn.State = data.StateBinding
+		utils.ArmDeadline(r, conn)
+		return
+	}
+
+	domain, destIP := host, net.IP(nil)
+	if addressType != data.AtypDomain {
+		domain, destIP = "", net.ParseIP(host)
+	}
+	allowed, decided := acl.Check(conn.ClientIP, domain, destIP, port)
+	proxy := chain.Route(domain, destIP)
+	// The parent proxy resolves a chained name itself, so rules on networks that could still
+	// change the answer are never checked: such requests are refused.
+	if !allowed && decided || proxy != nil && !decided {
+		utils.SendSocksReply(r, conn, data.RepConnectionNotAllowed, data.AtypIPv4, nil, 0)
+		utils.CloseConn(r, conn)
+		return
+	}
+
+	if proxy != nil {
+		conn.Chain = &data.ChainHandshake{IsHTTP: proxy.IsHTTP, Username: proxy.Username,
+			Password: proxy.Password, Host: host, Port: port}
+		if !connect.StartUpstreamConnect(r, conn, proxy.IP.String(), proxy.Port, proxy.IP.To4() == nil) {
+			utils.CloseConn(r, conn)
+			return
+		}
+		conn.State = data.StateConnecting
+		utils.ArmDeadline(r, conn)
+		return
+	}
+
+	if addressType == data.AtypDomain {
+		conn.State = data.StateResolving
+		utils.ArmDeadline(r, conn)
+		if err := dns.ResolveAndConnect(r, conn, host, port); err != nil {
+			utils.SendSocksReply(r, conn, utils.ReplyForError(err), data.AtypIPv4, nil, 0)
+			utils.CloseConn(r, conn)
+		}
+		return
+	}
+
+	if !connect.StartUpstreamConnect(r, conn, host, port, addressType == data.AtypIPv6) {
+		utils.CloseConn(r, conn)
+		return
+	}
+	conn.State = data.StateConnecting
+	utils.ArmDeadline(r, conn)
+}
+
+// verifyCredentials checks the password on an auth worker and calls done on the loop with the
+// answer; until then the handshake stops with AuthPending set and the client is not read. A full
+// queue counts as a failure.
+func verifyCredentials(r *data.Reactor, conn *data.Conn, username string, password string, done func(ok bool)) {
+	conn.AuthPending = true
+	queued := auth.VerifyAsync(username, password, func(ok bool) {
+		utils.Post(r, func() {
+			if conn.ClientFD < 0 {
+				return
+			}
+			conn.AuthPending = false
+			utils.UpdateClientEvents(r, conn)
+			done(ok)
+		})
+	})
+	if !queued {
+		conn.AuthPending = false
+		done(false)
+		return
+	}
+	utils.UpdateClientEvents(r, conn)
+}
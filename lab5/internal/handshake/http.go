@@ -0,0 +1,127 @@
+package handshake
+
+import (
+	"bytes"
+	"encoding/base64"
+	"lab5/internal/auth"
+	"lab5/internal/data"
+	"lab5/internal/utils"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxHTTPRequestSize = 8 * 1024
+	proxyAuthenticate  = "Proxy-Authenticate: Basic realm=\"lab5\"\r\n"
+)
+
+// isHTTPRequestStart reports whether the first byte from a client starts an HTTP method name.
+func isHTTPRequestStart(b byte) bool {
+	return b >= 'A' && b <= 'Z'
+}
+
+// processHTTPRequest handles "CONNECT host:port HTTP/1.1" once all headers have arrived and
+// feeds it into the same pipeline as a SOCKS5 CONNECT.
+func processHTTPRequest(r *data.Reactor, conn *data.Conn) {
+	request := conn.HandshakeBuffer.Bytes()
+	end := bytes.Index(request, []byte("\r\n\r\n"))
+	if end > maxHTTPRequestSize || end < 0 && len(request) > maxHTTPRequestSize {
+		rejectHTTP(r, conn, "431 Request Header Fields Too Large", "")
+		return
+	}
+	if end < 0 {
+		return
+	}
+
+	req, status, headers := parseHTTPRequest(string(request[:end]))
+	conn.HandshakeBuffer.Next(end + 4)
+	if status != "" {
+		rejectHTTP(r, conn, status, headers)
+		return
+	}
+
+	if auth.Store == nil {
+		startHTTPConnect(r, conn, req.host, req.port)
+		return
+	}
+	username, password, ok := proxyCredentials(req.headers)
+	if !ok {
+		rejectHTTP(r, conn, "407 Proxy Authentication Required", proxyAuthenticate)
+		return
+	}
+	verifyCredentials(r, conn, username, password, func(ok bool) {
+		if !ok {
+			rejectHTTP(r, conn, "407 Proxy Authentication Required", proxyAuthenticate)
+			return
+		}
+		conn.Username = username
+		startHTTPConnect(r, conn, req.host, req.port)
+	})
+}
+
+type httpRequest struct {
+	host    string
+	port    int
+	headers []string
+}
+
+// parseHTTPRequest parses a request head without its final blank line. A request that cannot be
+// served comes back with the status and extra headers to refuse it with.
+func parseHTTPRequest(head string) (httpRequest, string, string) {
+	lines := strings.Split(head, "\r\n")
+
+	// Request line: CONNECT example.com:443 HTTP/1.1
+	fields := strings.Fields(lines[0])
+	if len(fields) != 3 || !strings.HasPrefix(fields[2], "HTTP/1.") {
+		return httpRequest{}, "400 Bad Request", ""
+	}
+	if fields[0] != "CONNECT" {
+		return httpRequest{}, "405 Method Not Allowed", "Allow: CONNECT\r\n"
+	}
+	host, portStr, err := net.SplitHostPort(fields[1])
+	port, portErr := strconv.Atoi(portStr)
+	if err != nil || portErr != nil || host == "" || port <= 0 || port > 65535 {
+		return httpRequest{}, "400 Bad Request", ""
+	}
+	return httpRequest{host: host, port: port, headers: lines[1:]}, "", ""
+}
+
+func startHTTPConnect(r *data.Reactor, conn *data.Conn, host string, port int) {
+	addressType := byte(data.AtypDomain)
+	if ip := net.ParseIP(host); ip != nil {
+		addressType = data.AtypIPv6
+		if ip.To4() != nil {
+			addressType = data.AtypIPv4
+		}
+	} else if len(host) > 255 {
+		rejectHTTP(r, conn, "400 Bad Request", "")
+		return
+	}
+	startCommand(r, conn, data.SocksCmdConnect, addressType, host, port)
+}
+
+// proxyCredentials extracts the Basic credentials from the Proxy-Authorization header.
+func proxyCredentials(headers []string) (string, string, bool) {
+	for _, header := range headers {
+		name, value, found := strings.Cut(header, ":")
+		if !found || !strings.EqualFold(strings.TrimSpace(name), "Proxy-Authorization") {
+			continue
+		}
+		scheme, encoded, _ := strings.Cut(strings.TrimSpace(value), " ")
+		if !strings.EqualFold(scheme, "Basic") {
+			return "", "", false
+		}
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return "", "", false
+		}
+		return strings.Cut(string(decoded), ":")
+	}
+	return "", "", false
+}
+
+func rejectHTTP(r *data.Reactor, conn *data.Conn, status string, headers string) {
+	utils.SendHTTPResponse(r, conn, status, headers)
+	utils.CloseConn(r, conn)
+}
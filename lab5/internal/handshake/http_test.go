@@ -0,0 +1,171 @@
+package handshake
+
+import (
+	"encoding/base64"
+	"errors"
+	"lab5/internal/auth"
+	"lab5/internal/bufferPool"
+	"lab5/internal/data"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+type testStore struct{}
+
+func (testStore) Verify(username, password string) bool {
+	return username == "alice" && password == "secret"
+}
+
+// testConn returns a conn in the greeting state whose client is the other end of a socketpair.
+func testConn(t *testing.T) (*data.Reactor, *data.Conn, int) {
+	t.Helper()
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_NONBLOCK, 0)
+	if err != nil {
+		t.Fatalf("socketpair: %v", err)
+	}
+	t.Cleanup(func() { _ = unix.Close(fds[1]) })
+	r := data.NewReactor()
+	conn := &data.Conn{
+		ClientFD:               fds[0],
+		UpstreamFD:             -1,
+		UDPRelayFD:             -1,
+		State:                  data.StateGreeting,
+		ClientToUpstreamBuffer: bufferPool.NewQueue(r.Pool),
+		UpstreamToClientBuffer: bufferPool.NewQueue(r.Pool),
+	}
+	t.Cleanup(func() {
+		if conn.ClientFD >= 0 {
+			_ = unix.Close(conn.ClientFD)
+		}
+	})
+	return r, conn, fds[1]
+}
+
+func readReply(t *testing.T, fd int) string {
+	t.Helper()
+	buffer := make([]byte, 4096)
+	n, err := unix.Read(fd, buffer)
+	if err != nil {
+		if errors.Is(err, unix.EAGAIN) {
+			return ""
+		}
+		t.Fatalf("read: %v", err)
+	}
+	return string(buffer[:n])
+}
+
+func TestParseHTTPRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		head    string
+		host    string
+		port    int
+		headers []string
+		status  string
+	}{
+		{name: "domain", head: "CONNECT example.com:443 HTTP/1.1", host: "example.com", port: 443, headers: []string{}},
+		{
+			name: "headers", head: "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nUser-Agent: test",
+			host: "example.com", port: 443, headers: []string{"Host: example.com:443", "User-Agent: test"},
+		},
+		{name: "ipv6", head: "CONNECT [2001:db8::1]:8443 HTTP/1.0", host: "2001:db8::1", port: 8443, headers: []string{}},
+		{name: "other method", head: "GET http://example.com/ HTTP/1.1", status: "405 Method Not Allowed"},
+		{name: "no version", head: "CONNECT example.com:443", status: "400 Bad Request"},
+		{name: "http/2", head: "CONNECT example.com:443 HTTP/2", status: "400 Bad Request"},
+		{name: "extra field", head: "CONNECT example.com:443 HTTP/1.1 x", status: "400 Bad Request"},
+		{name: "no port", head: "CONNECT example.com HTTP/1.1", status: "400 Bad Request"},
+		{name: "port zero", head: "CONNECT example.com:0 HTTP/1.1", status: "400 Bad Request"},
+		{name: "port too large", head: "CONNECT example.com:65536 HTTP/1.1", status: "400 Bad Request"},
+		{name: "port not a number", head: "CONNECT example.com:https HTTP/1.1", status: "400 Bad Request"},
+		{name: "empty host", head: "CONNECT :443 HTTP/1.1", status: "400 Bad Request"},
+		{name: "empty", head: "", status: "400 Bad Request"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, status, _ := parseHTTPRequest(tt.head)
+			if status != tt.status {
+				t.Fatalf("status %q; want %q", status, tt.status)
+			}
+			if req.host != tt.host || req.port != tt.port || strings.Join(req.headers, "|") != strings.Join(tt.headers, "|") {
+				t.Errorf("parseHTTPRequest() = %+v; want %s %d %q", req, tt.host, tt.port, tt.headers)
+			}
+		})
+	}
+}
+
+func TestProxyCredentials(t *testing.T) {
+	basic := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	tests := []struct {
+		name     string
+		headers  []string
+		username string
+		password string
+		ok       bool
+	}{
+		{name: "basic", headers: []string{"Host: x", "Proxy-Authorization: Basic " + basic("alice:secret")}, username: "alice", password: "secret", ok: true},
+		{name: "case insensitive", headers: []string{"proxy-authorization:  basic  " + basic("alice:secret")}, username: "alice", password: "secret", ok: true},
+		{name: "colon in password", headers: []string{"Proxy-Authorization: Basic " + basic("alice:a:b")}, username: "alice", password: "a:b", ok: true},
+		{name: "empty password", headers: []string{"Proxy-Authorization: Basic " + basic("alice:")}, username: "alice", ok: true},
+		{name: "no header", headers: []string{"Host: x", "Authorization: Basic " + basic("alice:secret")}},
+		{name: "other scheme", headers: []string{"Proxy-Authorization: Bearer " + basic("alice:secret")}},
+		{name: "bad base64", headers: []string{"Proxy-Authorization: Basic !!!"}},
+		{name: "no colon", headers: []string{"Proxy-Authorization: Basic " + basic("alice")}, username: "alice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			username, password, ok := proxyCredentials(tt.headers)
+			if username != tt.username || password != tt.password || ok != tt.ok {
+				t.Errorf("proxyCredentials() = %q, %q, %v; want %q, %q, %v", username, password, ok, tt.username, tt.password, tt.ok)
+			}
+		})
+	}
+}
+
+func TestProcessHTTPRequestRejects(t *testing.T) {
+	saved := auth.Store
+	auth.Store = testStore{}
+	t.Cleanup(func() { auth.Store = saved })
+
+	tests := []struct {
+		name    string
+		request string
+		reply   string
+		header  string
+	}{
+		{name: "incomplete", request: "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com"},
+		{name: "no credentials", request: "CONNECT example.com:443 HTTP/1.1\r\n\r\n", reply: "HTTP/1.1 407 ", header: proxyAuthenticate},
+		{
+			name:    "other scheme",
+			request: "CONNECT example.com:443 HTTP/1.1\r\nProxy-Authorization: Bearer token\r\n\r\n",
+			reply:   "HTTP/1.1 407 ", header: proxyAuthenticate,
+		},
+		{name: "other method", request: "GET / HTTP/1.1\r\n\r\n", reply: "HTTP/1.1 405 ", header: "Allow: CONNECT\r\n"},
+		{
+			name:    "headers too large",
+			request: "CONNECT example.com:443 HTTP/1.1\r\nX: " + strings.Repeat("a", maxHTTPRequestSize),
+			reply:   "HTTP/1.1 431 ",
+		},
+		{
+			name:    "complete headers too large",
+			request: "CONNECT example.com:443 HTTP/1.1\r\nX: " + strings.Repeat("a", maxHTTPRequestSize) + "\r\n\r\n",
+			reply:   "HTTP/1.1 431 ",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, conn, client := testConn(t)
+			conn.HandshakeBuffer.WriteString(tt.request)
+			processHTTPRequest(r, conn)
+
+			reply := readReply(t, client)
+			if !strings.HasPrefix(reply, tt.reply) || !strings.Contains(reply, tt.header) {
+				t.Fatalf("reply %q; want %q with %q", reply, tt.reply, tt.header)
+			}
+			if closed := conn.ClientFD < 0; closed != (tt.reply != "") {
+				t.Errorf("closed = %v", closed)
+			}
+		})
+	}
+}
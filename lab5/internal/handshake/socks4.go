@@ -0,0 +1,77 @@
+package handshake
+
+import (
+	"bytes"
+	"encoding/binary"
+	"lab5/internal/auth"
+	"lab5/internal/data"
+	"lab5/internal/utils"
+	"net"
+)
+
+const (
+	socks4HeaderSize   = 8
+	socks4PortOffset   = 2
+	socks4IPOffset     = 4
+	maxSocks4FieldSize = 256
+)
+
+// processSocks4Request handles a SOCKS4 CONNECT (VN CD DSTPORT DSTIP USERID NUL) and its SOCKS4a
+// form, where DSTIP is 0.0.0.x and a NUL-terminated domain name follows the user id.
+func processSocks4Request(r *data.Reactor, conn *data.Conn) {
+	req, size, ok := parseSocks4Request(conn.HandshakeBuffer.Bytes())
+	if !ok {
+		utils.CloseConn(r, conn)
+		return
+	}
+	if size == 0 {
+		return
+	}
+	conn.HandshakeBuffer.Next(size)
+
+	// SOCKS4 carries no password, so it cannot pass -auth.
+	if req.command != data.SocksCmdConnect || auth.Store != nil || req.host == "" {
+		utils.SendSocksReply(r, conn, data.RepGeneralFailure, data.AtypIPv4, nil, 0)
+		utils.CloseConn(r, conn)
+		return
+	}
+	startCommand(r, conn, req.command, req.addressType, req.host, req.port)
+}
+
+type socks4Request struct {
+	command     byte
+	addressType byte
+	host        string
+	port        int
+}
+
+// parseSocks4Request returns the request at the start of request and its size, 0 while it is
+// incomplete. It fails when the user id or the domain runs past maxSocks4FieldSize without a NUL.
+func parseSocks4Request(request []byte) (socks4Request, int, bool) {
+	if len(request) < socks4HeaderSize+1 {
+		return socks4Request{}, 0, true
+	}
+	userEnd := bytes.IndexByte(request[socks4HeaderSize:], 0)
+	if userEnd < 0 {
+		return socks4Request{}, 0, len(request) <= socks4HeaderSize+maxSocks4FieldSize
+	}
+	size := socks4HeaderSize + userEnd + 1
+
+	ip := net.IP(request[socks4IPOffset:socks4HeaderSize])
+	req := socks4Request{
+		command:     request[commandOffset],
+		addressType: data.AtypIPv4,
+		host:        ip.String(),
+		port:        int(binary.BigEndian.Uint16(request[socks4PortOffset:])),
+	}
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		domainEnd := bytes.IndexByte(request[size:], 0)
+		if domainEnd < 0 {
+			return socks4Request{}, 0, len(request) <= size+maxSocks4FieldSize
+		}
+		req.addressType = data.AtypDomain
+		req.host = string(request[size : size+domainEnd])
+		size += domainEnd + 1
+	}
+	return req, size, true
+}
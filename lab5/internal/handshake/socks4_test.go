@@ -0,0 +1,61 @@
+package handshake
+
+import (
+	"bytes"
+	"lab5/internal/data"
+	"testing"
+)
+
+func socks4Header(command byte, ip ...byte) []byte {
+	return append([]byte{0x04, command, 0x01, 0xBB}, ip...)
+}
+
+func TestParseSocks4Request(t *testing.T) {
+	connect := socks4Header(data.SocksCmdConnect, 192, 0, 2, 1)
+	marker := socks4Header(data.SocksCmdConnect, 0, 0, 0, 1)
+	cat := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	long := bytes.Repeat([]byte{'a'}, maxSocks4FieldSize)
+
+	tests := []struct {
+		name        string
+		request     []byte
+		size        int
+		addressType byte
+		host        string
+		fails       bool
+	}{
+		{name: "empty user id", request: cat(connect, []byte{0}), size: 9, addressType: data.AtypIPv4, host: "192.0.2.1"},
+		{name: "user id", request: cat(connect, []byte("bob\x00")), size: 12, addressType: data.AtypIPv4, host: "192.0.2.1"},
+		{name: "data after the request", request: cat(connect, []byte("bob\x00GET /")), size: 12, addressType: data.AtypIPv4, host: "192.0.2.1"},
+		{name: "socks4a", request: cat(marker, []byte("bob\x00example.com\x00")), size: 24, addressType: data.AtypDomain, host: "example.com"},
+		{name: "socks4a without user id", request: cat(marker, []byte("\x00example.com\x00")), size: 21, addressType: data.AtypDomain, host: "example.com"},
+		{name: "socks4a empty domain", request: cat(marker, []byte("\x00\x00")), size: 10, addressType: data.AtypDomain, host: ""},
+		{name: "0.0.0.0 is not a marker", request: cat(socks4Header(data.SocksCmdConnect, 0, 0, 0, 0), []byte{0}), size: 9, addressType: data.AtypIPv4, host: "0.0.0.0"},
+		{name: "0.0.1.1 is not a marker", request: cat(socks4Header(data.SocksCmdConnect, 0, 0, 1, 1), []byte{0}), size: 9, addressType: data.AtypIPv4, host: "0.0.1.1"},
+		{name: "header only", request: connect},
+		{name: "partial header", request: connect[:5]},
+		{name: "user id without nul", request: cat(connect, []byte("bob"))},
+		{name: "user id without nul at the limit", request: cat(connect, long)},
+		{name: "user id over the limit", request: cat(connect, long, []byte("a")), fails: true},
+		{name: "domain without nul", request: cat(marker, []byte("\x00example"))},
+		{name: "domain without nul at the limit", request: cat(marker, []byte{0}, long)},
+		{name: "domain over the limit", request: cat(marker, []byte{0}, long, []byte("a")), fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, size, ok := parseSocks4Request(tt.request)
+			if ok == tt.fails {
+				t.Fatalf("ok = %v", ok)
+			}
+			if size != tt.size {
+				t.Fatalf("size %d; want %d", size, tt.size)
+			}
+			if size == 0 {
+				return
+			}
+			if req.command != data.SocksCmdConnect || req.port != 443 || req.addressType != tt.addressType || req.host != tt.host {
+				t.Errorf("parseSocks4Request() = %+v; want %#x %q port 443", req, tt.addressType, tt.host)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package metrics
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds, in seconds, of the latency histograms.
+var LatencyBuckets = [...]float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Histogram counts observations per bucket; Counts has one extra slot for +Inf.
+type Histogram struct {
+	Counts [len(LatencyBuckets) + 1]uint64
+	Sum    float64
+	Count  uint64
+}
+
+func (h *Histogram) Observe(seconds float64) {
+	i := 0
+	for i < len(LatencyBuckets) && seconds > LatencyBuckets[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Sum += seconds
+	h.Count++
+}
+
+func (h *Histogram) add(other *Histogram) {
+	for i := range h.Counts {
+		h.Counts[i] += other.Counts[i]
+	}
+	h.Sum += other.Sum
+	h.Count += other.Count
+}
+
+// Stats are the counters of one reactor. Only its event loop updates them, so they need no
+// locking; other goroutines only ever see the copies published in snapshots.
+type Stats struct {
+	Accepted          uint64
+	Refused           uint64
+	HandshakeFailures uint64
+	Replies           [256]uint64
+	BytesUp           uint64 // client -> upstream
+	BytesDown         uint64 // upstream -> client
+	DNSQueries        uint64
+	DNSFailures       uint64
+	DNSLatency        Histogram
+	ConnectLatency    Histogram
+}
+
+func (s *Stats) add(other *Stats) {
+	s.Accepted += other.Accepted
+	s.Refused += other.Refused
+	s.HandshakeFailures += other.HandshakeFailures
+	for i := range s.Replies {
+		s.Replies[i] += other.Replies[i]
+	}
+	s.BytesUp += other.BytesUp
+	s.BytesDown += other.BytesDown
+	s.DNSQueries += other.DNSQueries
+	s.DNSFailures += other.DNSFailures
+	s.DNSLatency.add(&other.DNSLatency)
+	s.ConnectLatency.add(&other.ConnectLatency)
+}
+
+// ConnInfo describes one open connection in /connections.
+type ConnInfo struct {
+	Reactor   int     `json:"reactor"`
+	Client    string  `json:"client"`
+	User      string  `json:"user,omitempty"`
+	Protocol  string  `json:"protocol"`
+	State     string  `json:"state"`
+	Target    string  `json:"target,omitempty"`
+	Upstream  string  `json:"upstream,omitempty"`
+	BytesUp   uint64  `json:"bytes_up"`
+	BytesDown uint64  `json:"bytes_down"`
+	Age       float64 `json:"age_seconds"`
+	Idle      float64 `json:"idle_seconds"`
+}
+
+// Snapshot is what a reactor publishes about itself.
+type Snapshot struct {
+	Stats     Stats
+	Conns     []ConnInfo
+	PoolInUse int
+	Taken     time.Time
+}
+
+// SnapshotInterval is how often reactors publish snapshots while the admin listener is on.
+const SnapshotInterval = time.Second
+
+var snapshots []atomic.Pointer[Snapshot]
+
+// DNSCacheStats reports hits, misses and entries of the DNS cache; set by the controller.
+var DNSCacheStats func() (hits uint64, misses uint64, size int)
+
+// AccessLogDropped reports access log records lost to a full queue; set by the controller.
+var AccessLogDropped func() uint64
+
+// Init prepares a snapshot slot for every reactor; it must run before the reactors start.
+func Init(reactors int) {
+	snapshots = make([]atomic.Pointer[Snapshot], reactors)
+}
+
+func Publish(reactor int, s *Snapshot) {
+	snapshots[reactor].Store(s)
+}
+
+func collect() []*Snapshot {
+	collected := make([]*Snapshot, 0, len(snapshots))
+	for i := range snapshots {
+		if s := snapshots[i].Load(); s != nil {
+			collected = append(collected, s)
+		}
+	}
+	return collected
+}
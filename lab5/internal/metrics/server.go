@@ -0,0 +1,118 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// Serve starts the admin HTTP listener with /metrics and /connections in its own goroutine.
+// It never touches reactor state directly, only the published snapshots.
+func Serve(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/connections", handleConnections)
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			fmt.Printf("admin server: %v\n", err)
+		}
+	}()
+	return nil
+}
+
+func handleConnections(w http.ResponseWriter, _ *http.Request) {
+	conns := []ConnInfo{}
+	for _, s := range collect() {
+		conns = append(conns, s.Conns...)
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Age > conns[j].Age })
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	_ = encoder.Encode(conns)
+}
+
+func handleMetrics(w http.ResponseWriter, _ *http.Request) {
+	var total Stats
+	active := make(map[string]int)
+	poolInUse := 0
+	for _, s := range collect() {
+		total.add(&s.Stats)
+		poolInUse += s.PoolInUse
+		for _, c := range s.Conns {
+			active[c.State]++
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	counter(w, "socks_connections_accepted_total", "Connections accepted by the listeners.", total.Accepted)
+	counter(w, "socks_connections_refused_total", "Connections refused because of the memory budget, connection limits or lack of descriptors.", total.Refused)
+	header(w, "socks_connections_active", "Open client connections by state.", "gauge")
+	states := make([]string, 0, len(active))
+	for state := range active {
+		states = append(states, state)
+	}
+	sort.Strings(states)
+	for _, state := range states {
+		fmt.Fprintf(w, "socks_connections_active{state=%q} %d\n", state, active[state])
+	}
+	counter(w, "socks_handshake_failures_total", "Connections closed during greeting, authentication or request.", total.HandshakeFailures)
+	header(w, "socks_replies_total", "Replies sent to clients by SOCKS reply code.", "counter")
+	for code, n := range total.Replies {
+		if n > 0 {
+			fmt.Fprintf(w, "socks_replies_total{code=\"0x%02x\"} %d\n", code, n)
+		}
+	}
+	header(w, "socks_relayed_bytes_total", "Bytes read from one side of relayed TCP connections.", "counter")
+	fmt.Fprintf(w, "socks_relayed_bytes_total{direction=\"upstream\"} %d\n", total.BytesUp)
+	fmt.Fprintf(w, "socks_relayed_bytes_total{direction=\"downstream\"} %d\n", total.BytesDown)
+	gauge(w, "socks_buffer_pool_bytes", "Memory held by relay buffers.", uint64(poolInUse))
+
+	counter(w, "socks_dns_queries_total", "DNS queries sent.", total.DNSQueries)
+	counter(w, "socks_dns_failures_total", "DNS queries that got no usable answer.", total.DNSFailures)
+	histogram(w, "socks_dns_latency_seconds", "Time from sending a DNS query to its answer.", &total.DNSLatency)
+	if DNSCacheStats != nil {
+		hits, misses, size := DNSCacheStats()
+		counter(w, "socks_dns_cache_hits_total", "DNS cache hits.", hits)
+		counter(w, "socks_dns_cache_misses_total", "DNS cache misses.", misses)
+		gauge(w, "socks_dns_cache_entries", "Answers in the DNS cache.", uint64(size))
+	}
+	histogram(w, "socks_connect_latency_seconds", "Time from the request to the success reply, resolution included.", &total.ConnectLatency)
+	if AccessLogDropped != nil {
+		counter(w, "socks_access_log_dropped_total", "Access log records dropped because the writer fell behind.", AccessLogDropped())
+	}
+}
+
+func header(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func counter(w io.Writer, name string, help string, value uint64) {
+	header(w, name, help, "counter")
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
+
+func gauge(w io.Writer, name string, help string, value uint64) {
+	header(w, name, help, "gauge")
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
+
+func histogram(w io.Writer, name string, help string, h *Histogram) {
+	header(w, name, help, "histogram")
+	var cumulative uint64
+	for i, bound := range LatencyBuckets {
+		cumulative += h.Counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.Count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.Sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, h.Count)
+}
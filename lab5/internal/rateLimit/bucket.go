@@ -0,0 +1,74 @@
+package rateLimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// minBurst lets a slow bucket still fill a reasonable read.
+	minBurst = 16 * 1024
+	// minRead keeps a throttled connection from waking up for a few bytes at a time.
+	minRead = 4 * 1024
+	// minWait is the shortest pause; shorter timers would mostly cost wakeups.
+	minWait = time.Millisecond
+)
+
+// Bucket is a token bucket of bytes. Buckets for a client IP, a user or the whole proxy are
+// shared by connections on different reactors, so it is locked.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate int64) *Bucket {
+	burst := math.Max(float64(rate), minBurst)
+	return &Bucket{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// refill must be called with mu held.
+func (b *Bucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// Allowance returns how many of size bytes the buckets allow to read now. When that is 0 it also
+// returns how long to wait until a read of a useful size is allowed.
+func Allowance(buckets []*Bucket, size int) (int, time.Duration) {
+	now := time.Now()
+	allowed, wait := size, time.Duration(0)
+	for _, b := range buckets {
+		b.mu.Lock()
+		b.refill(now)
+		want := math.Min(float64(size), minRead)
+		if b.tokens < want {
+			if need := time.Duration((want - b.tokens) / b.rate * float64(time.Second)); need > wait {
+				wait = need
+			}
+			allowed = 0
+		} else if int(b.tokens) < allowed {
+			allowed = int(b.tokens)
+		}
+		b.mu.Unlock()
+	}
+	if allowed == 0 {
+		return 0, max(wait, minWait)
+	}
+	return allowed, 0
+}
+
+// Consume takes n bytes from every bucket. Other connections may have drawn from a shared bucket
+// since Allowance, so tokens can go negative; the debt delays the next reads.
+func Consume(buckets []*Bucket, n int) {
+	now := time.Now()
+	for _, b := range buckets {
+		b.mu.Lock()
+		b.refill(now)
+		b.tokens -= float64(n)
+		b.mu.Unlock()
+	}
+}
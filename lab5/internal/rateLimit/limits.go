@@ -0,0 +1,210 @@
+package rateLimit
+
+import (
+	"bufio"
+	"fmt"
+	"lab5/internal/acl"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type clientRule struct {
+	client *net.IPNet // nil matches any client
+	rate   int64
+}
+
+// Limits are rates in bytes per second, each applied to both directions separately; 0 means
+// no limit. Connections sharing a client IP, a user or the proxy draw from the same buckets,
+// which live as long as some connection uses them.
+type Limits struct {
+	global      int64
+	users       map[string]int64
+	defaultUser int64
+	clients     []clientRule
+	lines       int
+
+	mu      sync.Mutex
+	buckets map[string]*entry
+}
+
+type entry struct {
+	up   *Bucket
+	down *Bucket
+	refs int
+}
+
+// limits is nil when the proxy runs without shaping. On reload new connections get buckets of
+// the new Limits while open ones keep theirs.
+var limits atomic.Pointer[Limits]
+
+func SetLimits(l *Limits) {
+	limits.Store(l)
+}
+
+func (l *Limits) Len() int {
+	return l.lines
+}
+
+// Load reads lines of the form "global * <rate>", "user <name>|* <rate>" and
+// "client <cidr>|* <rate>", where rate is bytes per second with an optional K, M or G suffix.
+// The first client line that matches wins; a named user overrides "user *".
+func Load(filePath string) (*Limits, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+
+	l := &Limits{users: make(map[string]int64), buckets: make(map[string]*entry)}
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if err := l.parseLine(fields); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filePath, lineNum, err)
+		}
+		l.lines++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Limits) parseLine(fields []string) error {
+	if len(fields) != 3 {
+		return fmt.Errorf("expected: global|user|client <who> <rate>")
+	}
+	rate, err := ParseRate(fields[2])
+	if err != nil {
+		return err
+	}
+	switch fields[0] {
+	case "global":
+		if fields[1] != "*" {
+			return fmt.Errorf("global takes \"*\"")
+		}
+		l.global = rate
+	case "user":
+		if fields[1] == "*" {
+			l.defaultUser = rate
+		} else {
+			l.users[fields[1]] = rate
+		}
+	case "client":
+		rule := clientRule{rate: rate}
+		if fields[1] != "*" {
+			if rule.client, err = acl.ParseNet(fields[1]); err != nil {
+				return fmt.Errorf("client: %v", err)
+			}
+		}
+		l.clients = append(l.clients, rule)
+	default:
+		return fmt.Errorf("unknown scope %q", fields[0])
+	}
+	return nil
+}
+
+// ParseRate parses bytes per second such as 65536, 512K, 10M or 1G (powers of 1024).
+func ParseRate(s string) (int64, error) {
+	if s == "" {
+		return 0, fmt.Errorf("empty rate")
+	}
+	multiplier := int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	digits := s
+	if multiplier > 1 {
+		digits = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("bad rate %q", s)
+	}
+	return n * multiplier, nil
+}
+
+// Set is what one connection draws from: a bucket per direction for each limit that applies.
+type Set struct {
+	Up     []*Bucket
+	Down   []*Bucket
+	limits *Limits
+	keys   []string
+}
+
+// ForConn picks the buckets for a connection; it returns nil when nothing limits it.
+func ForConn(clientIP net.IP, user string) *Set {
+	l := limits.Load()
+	if l == nil {
+		return nil
+	}
+	s := &Set{limits: l}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.global > 0 {
+		s.add("global", l.global)
+	}
+	if user != "" {
+		rate, found := l.users[user]
+		if !found {
+			rate = l.defaultUser
+		}
+		if rate > 0 {
+			s.add("user "+user, rate)
+		}
+	}
+	for _, rule := range l.clients {
+		if rule.client == nil || rule.client.Contains(clientIP) {
+			if rule.rate > 0 {
+				s.add("client "+clientIP.String(), rule.rate)
+			}
+			break
+		}
+	}
+	if len(s.keys) == 0 {
+		return nil
+	}
+	return s
+}
+
+// add must be called with limits.mu held.
+func (s *Set) add(key string, rate int64) {
+	e := s.limits.buckets[key]
+	if e == nil {
+		e = &entry{up: newBucket(rate), down: newBucket(rate)}
+		s.limits.buckets[key] = e
+	}
+	e.refs++
+	s.Up = append(s.Up, e.up)
+	s.Down = append(s.Down, e.down)
+	s.keys = append(s.keys, key)
+}
+
+// Release drops the connection's references; buckets nobody uses any more are forgotten.
+func (s *Set) Release() {
+	s.limits.mu.Lock()
+	defer s.limits.mu.Unlock()
+	for _, key := range s.keys {
+		if e := s.limits.buckets[key]; e != nil {
+			if e.refs--; e.refs == 0 {
+				delete(s.limits.buckets, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package rateLimit
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		rate  string
+		want  int64
+		fails bool
+	}{
+		{rate: "65536", want: 65536},
+		{rate: "512K", want: 512 << 10},
+		{rate: "512k", want: 512 << 10},
+		{rate: "10M", want: 10 << 20},
+		{rate: "1G", want: 1 << 30},
+		{rate: "0", want: 0},
+		{rate: "0M", want: 0},
+		{rate: "", fails: true},
+		{rate: "K", fails: true},
+		{rate: "-1", fails: true},
+		{rate: "1.5M", fails: true},
+		{rate: "10T", fails: true},
+		{rate: "10MB", fails: true},
+		{rate: "9223372036854775807K", fails: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRate(tt.rate)
+		if tt.fails {
+			if err == nil {
+				t.Errorf("ParseRate(%q) = %d, want an error", tt.rate, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseRate(%q) = %d, %v; want %d", tt.rate, got, err, tt.want)
+		}
+	}
+}
+
+func TestZeroRateIsUnlimited(t *testing.T) {
+	tests := []struct {
+		name    string
+		lines   []string
+		user    string
+		limited bool
+	}{
+		{name: "zero global", lines: []string{"global * 0"}},
+		{name: "zero default user", lines: []string{"user * 0"}, user: "bob"},
+		{name: "zero client", lines: []string{"client * 0", "client 10.0.0.0/8 1M"}},
+		{name: "named user over zero default", lines: []string{"user * 0", "user bob 1M"}, user: "bob", limited: true},
+		{name: "zero named user over default", lines: []string{"user * 1M", "user bob 0"}, user: "bob"},
+		{name: "other user", lines: []string{"user * 0", "user bob 1M"}, user: "alice"},
+		{name: "client rate", lines: []string{"client 10.0.0.0/8 1M"}, limited: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &Limits{users: make(map[string]int64), buckets: make(map[string]*entry)}
+			for _, line := range tt.lines {
+				if err := l.parseLine(strings.Fields(line)); err != nil {
+					t.Fatalf("parseLine(%q): %v", line, err)
+				}
+			}
+			SetLimits(l)
+			t.Cleanup(func() { SetLimits(nil) })
+
+			set := ForConn([]byte{10, 0, 0, 1}, tt.user)
+			if limited := set != nil; limited != tt.limited {
+				t.Fatalf("limited = %v; want %v", limited, tt.limited)
+			}
+			if set != nil {
+				set.Release()
+			}
+			if len(l.buckets) != 0 {
+				t.Errorf("%d buckets left after Release", len(l.buckets))
+			}
+		})
+	}
+}
+
+// bucketState describes a bucket: tokens left when it was last used, idle ago. A bucket idle
+// for an hour is full.
+type bucketState struct {
+	rate   int64
+	tokens float64
+	idle   time.Duration
+}
+
+func testBuckets(states []bucketState) []*Bucket {
+	var buckets []*Bucket
+	for _, state := range states {
+		b := newBucket(state.rate)
+		b.tokens = state.tokens
+		b.last = time.Now().Add(-state.idle)
+		buckets = append(buckets, b)
+	}
+	return buckets
+}
+
+func TestAllowance(t *testing.T) {
+	const mib = 1 << 20
+	full := time.Hour
+	tests := []struct {
+		name    string
+		buckets []bucketState
+		size    int
+		allowed int
+		wait    time.Duration // 0 when allowed, checked to within 10%
+	}{
+		{name: "full bucket", buckets: []bucketState{{mib, 0, full}}, size: 64 * 1024, allowed: 64 * 1024},
+		{name: "burst caps a read", buckets: []bucketState{{mib, 0, full}}, size: 2 * mib, allowed: mib},
+		{name: "slow bucket has the minimum burst", buckets: []bucketState{{1000, 0, full}}, size: 64 * 1024, allowed: minBurst},
+		{name: "small read below minRead", buckets: []bucketState{{mib, 200, 0}}, size: 100, allowed: 100},
+		{name: "empty bucket", buckets: []bucketState{{mib, 0, 0}}, size: 64 * 1024, wait: minRead * time.Second / mib},
+		{name: "fewer tokens than minRead", buckets: []bucketState{{mib, 1000, 0}}, size: 64 * 1024, wait: (minRead - 1000) * time.Second / mib},
+		{name: "debt", buckets: []bucketState{{mib, -mib, 0}}, size: 64 * 1024, wait: time.Second + minRead*time.Second/mib},
+		{name: "short waits are rounded up", buckets: []bucketState{{10 * mib, -4000, 0}}, size: 64 * 1024, wait: minWait},
+		{name: "refill after idle", buckets: []bucketState{{64 * 1024, 0, 500 * time.Millisecond}}, size: mib, allowed: 32 * 1024},
+		{name: "refill stops at the burst", buckets: []bucketState{{64 * 1024, 0, full}}, size: mib, allowed: 64 * 1024},
+		{name: "smallest of several buckets", buckets: []bucketState{{mib, 0, full}, {64 * 1024, 8192, 0}}, size: 64 * 1024, allowed: 8192},
+		{
+			name:    "longest wait of several buckets",
+			buckets: []bucketState{{mib, 0, 0}, {mib, -mib, 0}, {mib, 0, full}},
+			size:    64 * 1024, wait: time.Second + minRead*time.Second/mib,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed, wait := Allowance(testBuckets(tt.buckets), tt.size)
+			if tt.wait == 0 {
+				// Time passes between building the buckets and the call, so a few bytes may refill.
+				if wait != 0 || allowed < tt.allowed || allowed > tt.allowed+tt.allowed/100 {
+					t.Errorf("Allowance() = %d, %v; want %d", allowed, wait, tt.allowed)
+				}
+				return
+			}
+			if allowed != 0 || wait > tt.wait+tt.wait/10 || wait < tt.wait-tt.wait/10 {
+				t.Errorf("Allowance() = %d, %v; want a wait of %v", allowed, wait, tt.wait)
+			}
+		})
+	}
+}
+
+func TestConsume(t *testing.T) {
+	shared := newBucket(64 * 1024)
+	Consume([]*Bucket{shared}, 48*1024)
+	Consume([]*Bucket{shared}, 48*1024)
+	if shared.tokens > -32*1024+100 || shared.tokens < -32*1024 {
+		t.Fatalf("tokens %.0f after overdrawing; want about -32K", shared.tokens)
+	}
+	if allowed, wait := Allowance([]*Bucket{shared}, 64*1024); allowed != 0 || wait < 500*time.Millisecond {
+		t.Errorf("Allowance() = %d, %v; want a wait for the debt", allowed, wait)
+	}
+}
@@ -0,0 +1,119 @@
+package timer
+
+import (
+	"container/heap"
+	"errors"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+type Timer struct {
+	deadline time.Time
+	callback func()
+	index    int
+}
+
+// Queue keeps timers ordered by deadline and arms a timerfd for the earliest one,
+// so the owning epoll loop wakes up exactly when something is due.
+type Queue struct {
+	FD     int
+	timers timerHeap
+}
+
+func NewQueue() (*Queue, error) {
+	fd, err := unix.TimerfdCreate(unix.CLOCK_MONOTONIC, unix.TFD_NONBLOCK|unix.TFD_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &Queue{FD: fd}, nil
+}
+
+func (q *Queue) Close() error {
+	if q.FD < 0 {
+		return nil
+	}
+	err := unix.Close(q.FD)
+	q.FD = -1
+	return err
+}
+
+func (q *Queue) Add(after time.Duration, callback func()) *Timer {
+	t := &Timer{deadline: time.Now().Add(after), callback: callback}
+	heap.Push(&q.timers, t)
+	if t.index == 0 {
+		q.arm()
+	}
+	return t
+}
+
+func (q *Queue) Stop(t *Timer) {
+	if t == nil || t.index < 0 {
+		return
+	}
+	wasFirst := t.index == 0
+	heap.Remove(&q.timers, t.index)
+	if wasFirst {
+		q.arm()
+	}
+}
+
+// HandleExpired drains the timerfd and runs every callback whose deadline has passed.
+func (q *Queue) HandleExpired() {
+	expirations := make([]byte, 8)
+	for {
+		_, err := unix.Read(q.FD, expirations)
+		if err != nil {
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+			break
+		}
+	}
+
+	now := time.Now()
+	for len(q.timers) > 0 && !q.timers[0].deadline.After(now) {
+		t := heap.Pop(&q.timers).(*Timer)
+		t.callback()
+	}
+	q.arm()
+}
+
+func (q *Queue) arm() {
+	spec := unix.ItimerSpec{}
+	if len(q.timers) > 0 {
+		delay := time.Until(q.timers[0].deadline)
+		if delay <= 0 {
+			delay = time.Nanosecond
+		}
+		spec.Value = unix.NsecToTimespec(delay.Nanoseconds())
+	}
+	_ = unix.TimerfdSettime(q.FD, 0, &spec, nil)
+}
+
+type timerHeap []*Timer
+
+func (h timerHeap) Len() int { return len(h) }
+
+func (h timerHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x any) {
+	t := x.(*Timer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *timerHeap) Pop() any {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	t.index = -1
+	*h = old[:len(old)-1]
+	return t
+}
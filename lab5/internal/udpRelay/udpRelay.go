@@ -0,0 +1,218 @@
+package udpRelay
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"lab5/internal/acl"
+	"lab5/internal/data"
+	"lab5/internal/dns"
+	"lab5/internal/rateLimit"
+	"lab5/internal/utils"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	headerMinSize = 4
+	ipv4AddrSize  = 4
+	ipv6AddrSize  = 16
+	portSize      = 2
+
+	fragOffset        = 2
+	addressTypeOffset = 3
+	addressOffset     = 4
+	domainStartOffset = 5
+)
+
+func StartAssociate(r *data.Reactor, conn *data.Conn, host string, port int) bool {
+	localSa, err := unix.Getsockname(conn.ClientFD)
+	if err != nil {
+		utils.SendSocksReply(r, conn, data.RepGeneralFailure, data.AtypIPv4, nil, 0)
+		return false
+	}
+	peerSa, err := unix.Getpeername(conn.ClientFD)
+	if err != nil {
+		utils.SendSocksReply(r, conn, data.RepGeneralFailure, data.AtypIPv4, nil, 0)
+		return false
+	}
+	localIP, _ := utils.SockaddrToIP(localSa)
+	peerIP, _ := utils.SockaddrToIP(peerSa)
+
+	isIPv6 := localIP.To4() == nil
+	var relayFd int
+	if isIPv6 {
+		relayFd, err = unix.Socket(unix.AF_INET6, unix.SOCK_DGRAM, 0)
+	} else {
+		relayFd, err = unix.Socket(unix.AF_INET, unix.SOCK_DGRAM, 0)
+	}
+	if err != nil {
+		utils.SendSocksReply(r, conn, data.RepGeneralFailure, data.AtypIPv4, nil, 0)
+		return false
+	}
+
+	conn.UDPRelayFD = relayFd
+	conn.UDPRelayIsIPv6 = isIPv6
+	r.FdsInfo[relayFd] = &data.FDInfo{Conn: conn, IsUDPRelay: true}
+
+	if isIPv6 {
+		_ = unix.SetsockoptInt(relayFd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, 0)
+	}
+	if err = unix.SetNonblock(relayFd, true); err != nil {
+		utils.SendSocksReply(r, conn, data.RepGeneralFailure, data.AtypIPv4, nil, 0)
+		return false
+	}
+	if err = unix.Bind(relayFd, utils.IPToSockaddr(localIP, 0, isIPv6)); err != nil {
+		utils.SendSocksReply(r, conn, data.RepGeneralFailure, data.AtypIPv4, nil, 0)
+		return false
+	}
+	boundSa, err := unix.Getsockname(relayFd)
+	if err != nil {
+		utils.SendSocksReply(r, conn, data.RepGeneralFailure, data.AtypIPv4, nil, 0)
+		return false
+	}
+	if err = utils.EpollAdd(r, relayFd, unix.EPOLLIN); err != nil {
+		utils.SendSocksReply(r, conn, data.RepGeneralFailure, data.AtypIPv4, nil, 0)
+		return false
+	}
+
+	conn.UDPClientIP = peerIP
+	if hintIP := net.ParseIP(host); hintIP != nil && !hintIP.IsUnspecified() {
+		conn.UDPClientIP = hintIP
+	}
+	conn.UDPClientPort = port
+	conn.Limits = rateLimit.ForConn(conn.ClientIP, conn.Username)
+
+	boundIP, boundPort := utils.SockaddrToIP(boundSa)
+	return utils.SendAddrReply(r, conn, boundIP, boundPort)
+}
+
+func HandleRead(r *data.Reactor, conn *data.Conn) {
+	datagram := r.ReadBuffer[:data.UDPBufferSize]
+	for conn.UDPRelayFD >= 0 {
+		n, from, err := unix.Recvfrom(conn.UDPRelayFD, datagram, 0)
+		if err != nil {
+			if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EWOULDBLOCK) {
+				return
+			}
+			fmt.Printf("udp relay recvfrom: %v\n", err)
+			return
+		}
+		fromIP, fromPort := utils.SockaddrToIP(from)
+		if fromIP == nil {
+			continue
+		}
+		utils.Touch(conn)
+
+		if fromIP.Equal(conn.UDPClientIP) && (conn.UDPClientPort == 0 || conn.UDPClientPort == fromPort) {
+			conn.UDPClientPort = fromPort
+			forwardToRemote(r, conn, datagram[:n])
+		} else {
+			forwardToClient(r, conn, fromIP, fromPort, datagram[:n])
+		}
+	}
+}
+
+func forwardToRemote(r *data.Reactor, conn *data.Conn, datagram []byte) {
+	if len(datagram) < headerMinSize {
+		return
+	}
+	if datagram[fragOffset] != 0 {
+		return
+	}
+
+	switch datagram[addressTypeOffset] {
+	case data.AtypIPv4:
+		portStart := addressOffset + ipv4AddrSize
+		if len(datagram) < portStart+portSize {
+			return
+		}
+		ip := net.IP(datagram[addressOffset:portStart])
+		port := int(binary.BigEndian.Uint16(datagram[portStart : portStart+portSize]))
+		if acl.Allowed(conn.ClientIP, "", ip, port) && allowDatagram(r, conn, len(datagram)-portStart-portSize, true) {
+			sendTo(conn, ip, port, datagram[portStart+portSize:])
+		}
+
+	case data.AtypIPv6:
+		portStart := addressOffset + ipv6AddrSize
+		if len(datagram) < portStart+portSize {
+			return
+		}
+		ip := net.IP(datagram[addressOffset:portStart])
+		port := int(binary.BigEndian.Uint16(datagram[portStart : portStart+portSize]))
+		if acl.Allowed(conn.ClientIP, "", ip, port) && allowDatagram(r, conn, len(datagram)-portStart-portSize, true) {
+			sendTo(conn, ip, port, datagram[portStart+portSize:])
+		}
+
+	case data.AtypDomain:
+		if len(datagram) < domainStartOffset {
+			return
+		}
+		domainLen := int(datagram[addressOffset])
+		portStart := domainStartOffset + domainLen
+		if len(datagram) < portStart+portSize {
+			return
+		}
+		domain := string(datagram[domainStartOffset:portStart])
+		port := int(binary.BigEndian.Uint16(datagram[portStart : portStart+portSize]))
+		if !acl.Allowed(conn.ClientIP, domain, nil, port) {
+			return
+		}
+		payload := append([]byte(nil), datagram[portStart+portSize:]...)
+
+		err := dns.Resolve(r, conn, domain, func(ipStr string) {
+			ip := net.ParseIP(ipStr)
+			if conn.UDPRelayFD < 0 || !acl.Allowed(conn.ClientIP, domain, ip, port) || !allowDatagram(r, conn, len(payload), true) {
+				return
+			}
+			sendTo(conn, ip, port, payload)
+		})
+		if err != nil {
+			fmt.Printf("udp relay resolve %s: %v\n", domain, err)
+		}
+	}
+}
+
+func forwardToClient(r *data.Reactor, conn *data.Conn, fromIP net.IP, fromPort int, payload []byte) {
+	if conn.UDPClientPort == 0 || !allowDatagram(r, conn, len(payload), false) {
+		return
+	}
+
+	packet := []byte{0, 0, 0}
+	if ip4 := fromIP.To4(); ip4 != nil {
+		packet = append(packet, data.AtypIPv4)
+		packet = append(packet, ip4...)
+	} else {
+		packet = append(packet, data.AtypIPv6)
+		packet = append(packet, fromIP.To16()...)
+	}
+	packet = binary.BigEndian.AppendUint16(packet, uint16(fromPort))
+	packet = append(packet, payload...)
+
+	sendTo(conn, conn.UDPClientIP, conn.UDPClientPort, packet)
+}
+
+// allowDatagram counts a payload as relayed unless the rate limits are used up. UDP has no flow
+// control to pause, so a datagram that finds a bucket empty is dropped, as a congested link would
+// do; one that gets through takes its whole size, and the debt holds back the next ones.
+func allowDatagram(r *data.Reactor, conn *data.Conn, n int, up bool) bool {
+	if conn.Limits != nil {
+		buckets := conn.Limits.Down
+		if up {
+			buckets = conn.Limits.Up
+		}
+		if allowed, _ := rateLimit.Allowance(buckets, n); allowed == 0 {
+			return false
+		}
+	}
+	utils.CountRelayed(r, conn, n, up)
+	return true
+}
+
+func sendTo(conn *data.Conn, ip net.IP, port int, payload []byte) {
+	if ip == nil || (ip.To4() == nil && !conn.UDPRelayIsIPv6) {
+		return
+	}
+	_ = unix.Sendto(conn.UDPRelayFD, payload, 0, utils.IPToSockaddr(ip, port, conn.UDPRelayIsIPv6))
+}
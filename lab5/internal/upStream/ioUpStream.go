@@ -8,11 +8,12 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-func FlushUpstreamWrites(conn *data.Conn) {
-	if conn.UpstreamFD < 0 {
+func FlushUpstreamWrites(r *data.Reactor, conn *data.Conn) {
+	if conn.UpstreamFD < 0 || conn.State == data.StateBinding || conn.Chain != nil {
 		return
 	}
-	for conn.ClientToUpstreamBuffer.Len() > 0 {
+	writable := !conn.EdgeTriggered || conn.UpstreamWritable
+	for writable && conn.ClientToUpstreamBuffer.Len() > 0 {
 		bytes := conn.ClientToUpstreamBuffer.Bytes()
 		if len(bytes) == 0 {
 			break
@@ -23,15 +24,28 @@ func FlushUpstreamWrites(conn *data.Conn) {
 		}
 		if err != nil {
 			if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EWOULDBLOCK) {
-				_ = utils.EpollMod(conn.UpstreamFD, unix.EPOLLIN|unix.EPOLLOUT)
-				return
+				writable = false
+				break
 			}
-			utils.CloseConn(conn)
+			utils.CloseConn(r, conn)
 			return
 		}
 	}
-	_ = utils.EpollMod(conn.UpstreamFD, unix.EPOLLIN)
-	if conn.ClientClosed && conn.ClientToUpstreamBuffer.Len() == 0 {
+	if writable && conn.ClientToUpstreamBuffer.Len() == 0 && conn.ClientToUpstreamPipe != nil {
+		if err := utils.DrainPipe(conn.ClientToUpstreamPipe, conn.UpstreamFD); err != nil {
+			utils.CloseConn(r, conn)
+			return
+		}
+		writable = utils.PipePending(conn.ClientToUpstreamPipe) == 0
+	}
+	if conn.EdgeTriggered {
+		conn.UpstreamWritable = writable
+	}
+	utils.UpdateUpstreamEvents(r, conn)
+	if conn.ClientReadPaused {
+		utils.UpdateClientEvents(r, conn)
+	}
+	if conn.ClientClosed && conn.ClientToUpstreamBuffer.Len() == 0 && utils.PipePending(conn.ClientToUpstreamPipe) == 0 {
 		_ = unix.Shutdown(conn.UpstreamFD, unix.SHUT_WR)
 	}
 }
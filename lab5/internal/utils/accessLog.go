@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"fmt"
+	"lab5/internal/accessLog"
+	"lab5/internal/data"
+	"net"
+	"strconv"
+	"time"
+)
+
+// logAccess hands the record of a closing connection to the access log writer.
+func logAccess(conn *data.Conn) {
+	now := time.Now()
+	record := accessLog.Record{
+		Time:      now,
+		User:      conn.Username,
+		Protocol:  data.ProtocolNames[conn.Protocol],
+		Command:   data.CommandNames[conn.Command],
+		Atyp:      data.AtypNames[conn.TargetAtyp],
+		Host:      conn.TargetHost,
+		Port:      conn.TargetPort,
+		Upstream:  conn.Upstream,
+		BytesUp:   conn.BytesUp,
+		BytesDown: conn.BytesDown,
+		Duration:  now.Sub(conn.AcceptedAt).Seconds(),
+	}
+	if conn.ClientIP != nil {
+		record.Client = net.JoinHostPort(conn.ClientIP.String(), strconv.Itoa(conn.ClientPort))
+	}
+	if conn.Replied {
+		record.Reply = fmt.Sprintf("0x%02x", conn.Reply)
+	}
+
+	// Each phase lasts until the next one starts, or until the close if the next never did.
+	handshakeEnd := conn.RequestAt
+	if handshakeEnd.IsZero() {
+		handshakeEnd = now
+	}
+	record.Handshake = handshakeEnd.Sub(conn.AcceptedAt).Seconds()
+	if conn.RequestAt.IsZero() {
+		accessLog.Log(record)
+		return
+	}
+	connectStart := conn.RequestAt
+	if !conn.ResolvedAt.IsZero() {
+		connectStart = conn.ResolvedAt
+	} else if conn.State == data.StateResolving {
+		connectStart = now
+	}
+	record.Resolve = connectStart.Sub(conn.RequestAt).Seconds()
+	connectEnd := conn.ConnectedAt
+	if connectEnd.IsZero() {
+		connectEnd = now
+	} else {
+		record.Relay = now.Sub(connectEnd).Seconds()
+	}
+	record.Connect = connectEnd.Sub(connectStart).Seconds()
+	accessLog.Log(record)
+}
@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"lab5/internal/data"
+
+	"golang.org/x/sys/unix"
+)
+
+// EdgeTriggered switches relayed connections to EPOLLET; set by the controller.
+var EdgeTriggered = false
+
+const edgeEvents = unix.EPOLLIN | unix.EPOLLOUT | unix.EPOLLRDHUP | unix.EPOLLET
+
+// StartEdgeTriggered registers both sockets of a connection that starts relaying for every event
+// at once. The handshake and connect phases stay level-triggered; from here on flushes make no
+// epoll_ctl calls, only a direction that pauses and resumes reading does.
+func StartEdgeTriggered(r *data.Reactor, conn *data.Conn) {
+	if !EdgeTriggered || conn.ClientFD < 0 || conn.UpstreamFD < 0 {
+		return
+	}
+	conn.EdgeTriggered = true
+	// Sockets that are ready already are reported right after the mod, so readability is left to epoll.
+	conn.ClientWritable, conn.UpstreamWritable = true, true
+	conn.ClientInMasked, conn.UpstreamInMasked = false, false
+	epollSet(r, conn.ClientFD, edgeEvents)
+	epollSet(r, conn.UpstreamFD, edgeEvents)
+}
+
+// updateEdge is UpdateClientEvents and UpdateUpstreamEvents for edge-triggered conns: a direction
+// that may read again while data is waiting is queued for the loop instead of re-arming epoll.
+func updateEdge(r *data.Reactor, conn *data.Conn) {
+	clientPaused := conn.ClientReadPaused || conn.ClientThrottled
+	upstreamPaused := conn.UpstreamReadPaused || conn.UpstreamThrottled
+	// Without the mask a paused socket would report every arriving segment as a new edge.
+	if clientPaused != conn.ClientInMasked {
+		conn.ClientInMasked = clientPaused
+		epollSet(r, conn.ClientFD, maskedEvents(clientPaused))
+	}
+	if upstreamPaused != conn.UpstreamInMasked {
+		conn.UpstreamInMasked = upstreamPaused
+		epollSet(r, conn.UpstreamFD, maskedEvents(upstreamPaused))
+	}
+	clientCanRead := conn.ClientReadable && !clientPaused && !conn.ClientClosed
+	upstreamCanRead := conn.UpstreamReadable && !upstreamPaused && !conn.UpstreamClosed
+	if (clientCanRead || upstreamCanRead) && !conn.ResumeQueued {
+		conn.ResumeQueued = true
+		r.Resumed = append(r.Resumed, conn)
+	}
+}
+
+func maskedEvents(paused bool) uint32 {
+	if paused {
+		return edgeEvents &^ unix.EPOLLIN
+	}
+	return edgeEvents
+}
+
+// RelayDone reports that both peers have closed and everything they sent has been delivered.
+func RelayDone(conn *data.Conn) bool {
+	return conn.ClientClosed && conn.UpstreamClosed &&
+		conn.ClientToUpstreamBuffer.Len() == 0 && PipePending(conn.ClientToUpstreamPipe) == 0 &&
+		conn.UpstreamToClientBuffer.Len() == 0 && PipePending(conn.UpstreamToClientPipe) == 0
+}
+
+// markDrained records that a read from fd hit EAGAIN.
+func markDrained(conn *data.Conn, fd int) {
+	if fd == conn.ClientFD {
+		conn.ClientReadable = false
+	} else {
+		conn.UpstreamReadable = false
+	}
+}
@@ -0,0 +1,33 @@
+package utils
+
+import "lab5/internal/data"
+
+// httpStatuses translates SOCKS reply codes for clients that came in with HTTP CONNECT.
+var httpStatuses = map[byte]string{
+	data.RepSuccess:              "200 Connection established",
+	data.RepConnectionNotAllowed: "403 Forbidden",
+	data.RepNetworkUnreachable:   "502 Bad Gateway",
+	data.RepHostUnreachable:      "502 Bad Gateway",
+	data.RepConnectionRefused:    "502 Bad Gateway",
+	data.RepTTLExpired:           "504 Gateway Timeout",
+	data.RepCommandNotSupported:  "501 Not Implemented",
+	data.RepAddrTypeNotSupported: "501 Not Implemented",
+}
+
+func sendHTTPReply(r *data.Reactor, conn *data.Conn, rep byte) bool {
+	status, ok := httpStatuses[rep]
+	if !ok {
+		status = "502 Bad Gateway"
+	}
+	return SendHTTPResponse(r, conn, status, "")
+}
+
+// SendHTTPResponse writes a status line and optional extra header lines (each ending in CRLF).
+// Errors carry an empty body and the connection is closed after them.
+func SendHTTPResponse(r *data.Reactor, conn *data.Conn, status string, headers string) bool {
+	response := "HTTP/1.1 " + status + "\r\n" + headers
+	if status[0] != '2' {
+		response += "Content-Length: 0\r\nConnection: close\r\n"
+	}
+	return WriteAll(r, conn, conn.ClientFD, []byte(response+"\r\n"), false)
+}
@@ -0,0 +1,32 @@
+package utils
+
+import (
+	"encoding/binary"
+	"lab5/internal/data"
+	"log"
+
+	"golang.org/x/sys/unix"
+)
+
+// Post asks the reactor to run fn on its loop; it may be called from any goroutine.
+func Post(r *data.Reactor, fn func()) {
+	r.PostMu.Lock()
+	r.Posted = append(r.Posted, fn)
+	r.PostMu.Unlock()
+	if _, err := unix.Write(r.PostFD, binary.NativeEndian.AppendUint64(nil, 1)); err != nil {
+		log.Printf("eventfd write faile: %v", err)
+	}
+}
+
+// RunPosted runs what other goroutines have posted since the last call.
+func RunPosted(r *data.Reactor) {
+	buffer := make([]byte, 8)
+	_, _ = unix.Read(r.PostFD, buffer)
+	r.PostMu.Lock()
+	posted := r.Posted
+	r.Posted = nil
+	r.PostMu.Unlock()
+	for _, fn := range posted {
+		fn()
+	}
+}
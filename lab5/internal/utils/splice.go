@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"errors"
+	"lab5/internal/data"
+	"log"
+
+	"golang.org/x/sys/unix"
+)
+
+const spliceFlags = unix.SPLICE_F_MOVE | unix.SPLICE_F_NONBLOCK
+
+var SpliceEnabled = false
+
+var ErrSpliceUnsupported = errors.New("splice is not supported for this socket")
+
+// StartSplice gives a connection that enters StateRelaying a pipe per direction. When pipes cannot
+// be created the connection silently stays on the buffer path.
+func StartSplice(conn *data.Conn) {
+	if !SpliceEnabled || conn.ClientToUpstreamPipe != nil {
+		return
+	}
+	c2u, err := newPipe()
+	if err != nil {
+		return
+	}
+	u2c, err := newPipe()
+	if err != nil {
+		closePipe(c2u)
+		return
+	}
+	conn.ClientToUpstreamPipe = c2u
+	conn.UpstreamToClientPipe = u2c
+}
+
+func newPipe() (*data.SplicePipe, error) {
+	fds := make([]int, 2)
+	if err := unix.Pipe2(fds, unix.O_NONBLOCK|unix.O_CLOEXEC); err != nil {
+		return nil, err
+	}
+	p := &data.SplicePipe{ReadFD: fds[0], WriteFD: fds[1]}
+	_, _ = unix.FcntlInt(uintptr(p.WriteFD), unix.F_SETPIPE_SZ, data.SplicePipeSize)
+	size, err := unix.FcntlInt(uintptr(p.WriteFD), unix.F_GETPIPE_SZ, 0)
+	if err != nil {
+		closePipe(p)
+		return nil, err
+	}
+	p.Size = size
+	return p, nil
+}
+
+func closePipe(p *data.SplicePipe) {
+	for _, fd := range []int{p.ReadFD, p.WriteFD} {
+		err := unix.Close(fd)
+		if err != nil {
+			log.Printf("close(%d) faile: %v", fd, err)
+		}
+	}
+}
+
+// SpliceRead moves up to limit bytes from src into the pipe until the socket is drained or the
+// pipe is full and returns how much it moved. eof is reported when the peer has closed its side.
+func SpliceRead(conn *data.Conn, src int, p *data.SplicePipe, limit int) (moved int, eof bool, err error) {
+	for p.Pending < p.Size && moved < limit {
+		n, err := unix.Splice(src, nil, p.WriteFD, nil, min(p.Size-p.Pending, limit-moved), spliceFlags)
+		if n > 0 {
+			p.Pending += int(n)
+			moved += int(n)
+			Touch(conn)
+		}
+		if err != nil {
+			if errors.Is(err, unix.EAGAIN) {
+				if p.Pending > 0 {
+					p.Full = true
+				} else {
+					markDrained(conn, src)
+				}
+				return moved, false, nil
+			}
+			if errors.Is(err, unix.EINTR) {
+				return moved, false, nil
+			}
+			if errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOSYS) {
+				return moved, false, ErrSpliceUnsupported
+			}
+			return moved, false, err
+		}
+		if n == 0 {
+			return moved, true, nil
+		}
+	}
+	return moved, false, nil
+}
+
+// DrainPipe moves pending pipe data into dst; it stops without error when dst would block.
+func DrainPipe(p *data.SplicePipe, dst int) error {
+	for p.Pending > 0 {
+		n, err := unix.Splice(p.ReadFD, nil, dst, nil, p.Pending, spliceFlags)
+		if n > 0 {
+			p.Pending -= int(n)
+			p.Full = false
+		}
+		if err != nil {
+			if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+				return nil
+			}
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+	}
+	return nil
+}
+
+// StopSplice puts the connection back on the buffer path; it fails when a pipe still holds data.
+func StopSplice(conn *data.Conn) bool {
+	if PipePending(conn.ClientToUpstreamPipe) > 0 || PipePending(conn.UpstreamToClientPipe) > 0 {
+		return false
+	}
+	closePipes(conn)
+	return true
+}
+
+func PipePending(p *data.SplicePipe) int {
+	if p == nil {
+		return 0
+	}
+	return p.Pending
+}
+
+func pipeFull(p *data.SplicePipe) bool {
+	return p != nil && (p.Pending >= p.Size || p.Full)
+}
+
+func closePipes(conn *data.Conn) {
+	if conn.ClientToUpstreamPipe != nil {
+		closePipe(conn.ClientToUpstreamPipe)
+		conn.ClientToUpstreamPipe = nil
+	}
+	if conn.UpstreamToClientPipe != nil {
+		closePipe(conn.UpstreamToClientPipe)
+		conn.UpstreamToClientPipe = nil
+	}
+}
@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"lab5/internal/data"
+	"lab5/internal/rateLimit"
+	"time"
+)
+
+// Zero disables the corresponding timeout.
+var (
+	HandshakeTimeout = 10 * time.Second
+	ConnectTimeout   = 30 * time.Second
+	IdleTimeout      = 5 * time.Minute
+)
+
+// ArmDeadline replaces the connection deadline with the one for its current state. The handshake
+// deadline covers greeting, authentication and request together; the connect deadline covers DNS
+// resolution, the connection race, the parent proxy handshake and waiting for the BIND peer.
+func ArmDeadline(r *data.Reactor, conn *data.Conn) {
+	r.Timers.Stop(conn.Deadline)
+	conn.Deadline = nil
+	if conn.ClientFD < 0 {
+		return
+	}
+	conn.LastActivity = time.Now()
+
+	var timeout time.Duration
+	switch conn.State {
+	case data.StateGreeting, data.StateAuth, data.StateRequest:
+		timeout = HandshakeTimeout
+	case data.StateResolving, data.StateConnecting, data.StateChaining, data.StateBinding:
+		timeout = ConnectTimeout
+	default:
+		timeout = IdleTimeout
+	}
+	if timeout > 0 {
+		conn.Deadline = r.Timers.Add(timeout, func() { onDeadline(r, conn) })
+	}
+}
+
+// Touch records traffic on a relayed connection; the idle timer checks it lazily instead of being re-armed on every read.
+func Touch(conn *data.Conn) {
+	conn.LastActivity = time.Now()
+}
+
+// CountRelayed accounts n bytes read from the client (up) or from the upstream (down).
+// They are also taken from the connection's rate limit buckets.
+func CountRelayed(r *data.Reactor, conn *data.Conn, n int, up bool) {
+	if up {
+		conn.BytesUp += uint64(n)
+		r.Stats.BytesUp += uint64(n)
+	} else {
+		conn.BytesDown += uint64(n)
+		r.Stats.BytesDown += uint64(n)
+	}
+	if conn.Limits != nil && n > 0 {
+		if up {
+			rateLimit.Consume(conn.Limits.Up, n)
+		} else {
+			rateLimit.Consume(conn.Limits.Down, n)
+		}
+	}
+}
+
+// ReadAllowance caps a relay read by the connection's rate limits. When a bucket is empty it stops
+// polling the socket for reading and returns 0; a timer resumes it once the tokens are back.
+func ReadAllowance(r *data.Reactor, conn *data.Conn, up bool, size int) int {
+	if conn.Limits == nil {
+		return size
+	}
+	if up {
+		allowed, wait := rateLimit.Allowance(conn.Limits.Up, size)
+		if allowed == 0 {
+			conn.ClientThrottled = true
+			r.Timers.Stop(conn.ClientThrottle)
+			conn.ClientThrottle = r.Timers.Add(wait, func() {
+				conn.ClientThrottle = nil
+				conn.ClientThrottled = false
+				UpdateClientEvents(r, conn)
+			})
+			UpdateClientEvents(r, conn)
+		}
+		return allowed
+	}
+	allowed, wait := rateLimit.Allowance(conn.Limits.Down, size)
+	if allowed == 0 {
+		conn.UpstreamThrottled = true
+		r.Timers.Stop(conn.UpstreamThrottle)
+		conn.UpstreamThrottle = r.Timers.Add(wait, func() {
+			conn.UpstreamThrottle = nil
+			conn.UpstreamThrottled = false
+			UpdateUpstreamEvents(r, conn)
+		})
+		UpdateUpstreamEvents(r, conn)
+	}
+	return allowed
+}
+
+func onDeadline(r *data.Reactor, conn *data.Conn) {
+	conn.Deadline = nil
+	if conn.ClientFD < 0 {
+		return
+	}
+
+	switch conn.State {
+	case data.StateGreeting:
+		WriteAll(r, conn, conn.ClientFD, []byte{data.SocksVer, data.SocksMethodNoAcceptable}, false)
+	case data.StateAuth:
+		WriteAll(r, conn, conn.ClientFD, []byte{data.AuthVer, data.AuthStatusFailure}, false)
+	case data.StateRequest, data.StateResolving, data.StateConnecting, data.StateChaining, data.StateBinding:
+		SendSocksReply(r, conn, data.RepTTLExpired, data.AtypIPv4, nil, 0)
+	default:
+		if idle := time.Since(conn.LastActivity); idle < IdleTimeout {
+			conn.Deadline = r.Timers.Add(IdleTimeout-idle, func() { onDeadline(r, conn) })
+			return
+		}
+	}
+	CloseConn(r, conn)
+}
@@ -1,71 +1,183 @@
 package utils
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"lab5/internal/accessLog"
+	"lab5/internal/connLimit"
 	"lab5/internal/data"
 	"log"
+	"net"
 
 	"golang.org/x/sys/unix"
 )
 
-func EpollAdd(fd int, events uint32) error {
+func EpollAdd(r *data.Reactor, fd int, events uint32) error {
 	ev := &unix.EpollEvent{Events: events, Fd: int32(fd)}
-	return unix.EpollCtl(data.Epfd, unix.EPOLL_CTL_ADD, fd, ev)
+	return unix.EpollCtl(r.Epfd, unix.EPOLL_CTL_ADD, fd, ev)
 }
-func EpollMod(fd int, events uint32) error {
+func EpollMod(r *data.Reactor, fd int, events uint32) error {
 	ev := &unix.EpollEvent{Events: events, Fd: int32(fd)}
-	return unix.EpollCtl(data.Epfd, unix.EPOLL_CTL_MOD, fd, ev)
+	return unix.EpollCtl(r.Epfd, unix.EPOLL_CTL_MOD, fd, ev)
 }
-func EpollDel(fd int) { _ = unix.EpollCtl(data.Epfd, unix.EPOLL_CTL_DEL, fd, nil) }
+func EpollDel(r *data.Reactor, fd int) { _ = unix.EpollCtl(r.Epfd, unix.EPOLL_CTL_DEL, fd, nil) }
 
-func CleanupAllConnections() {
-	for fd, info := range data.FdsInfo {
+func CleanupAllConnections(r *data.Reactor) {
+	for fd, info := range r.FdsInfo {
 		if info != nil && info.Conn != nil {
-			CloseConn(info.Conn)
+			CloseConn(r, info.Conn)
 		}
-		delete(data.FdsInfo, fd)
+		if info != nil && info.Resolve != nil && info.Resolve.TCPFD == fd {
+			CloseResolveTCP(r, info.Resolve)
+		}
+		delete(r.FdsInfo, fd)
+	}
+}
+
+// CloseResolveTCP closes the TCP fallback socket of a DNS query and stops its timeout.
+func CloseResolveTCP(r *data.Reactor, p *data.PendingResolve) {
+	EpollDel(r, p.TCPFD)
+	if err := unix.Close(p.TCPFD); err != nil {
+		log.Printf("close(%d) faile: %v", p.TCPFD, err)
 	}
+	delete(r.FdsInfo, p.TCPFD)
+	p.TCPFD = -1
+	r.Timers.Stop(p.Timer)
+	p.Timer = nil
 }
 
-func CloseConn(conn *data.Conn) {
+func CloseConn(r *data.Reactor, conn *data.Conn) {
 	if conn == nil {
 		return
 	}
 	if conn.ClientFD >= 0 {
-		EpollDel(conn.ClientFD)
+		if conn.State == data.StateGreeting || conn.State == data.StateAuth || conn.State == data.StateRequest {
+			r.Stats.HandshakeFailures++
+		}
+		if accessLog.Enabled() {
+			logAccess(conn)
+		}
+		EpollDel(r, conn.ClientFD)
 		err := unix.Close(conn.ClientFD)
 		if err != nil {
 			log.Printf("close(%d) faile: %v", conn.ClientFD, err)
 		}
-		delete(data.FdsInfo, conn.ClientFD)
-		delete(data.Conns, conn.ClientFD)
+		delete(r.FdsInfo, conn.ClientFD)
+		delete(r.Conns, conn.ClientFD)
 		conn.ClientFD = -1
+		if conn.Counted {
+			connLimit.Release(conn.ClientIP)
+			conn.Counted = false
+		}
 	}
 	if conn.UpstreamFD >= 0 {
-		EpollDel(conn.UpstreamFD)
+		EpollDel(r, conn.UpstreamFD)
 		err := unix.Close(conn.UpstreamFD)
 		if err != nil {
 			log.Printf("close(%d) faile: %v", conn.UpstreamFD, err)
 		}
-		delete(data.FdsInfo, conn.UpstreamFD)
+		delete(r.FdsInfo, conn.UpstreamFD)
 		conn.UpstreamFD = -1
 	}
+	if conn.Race != nil {
+		for _, fd := range conn.Race.Attempts {
+			EpollDel(r, fd)
+			err := unix.Close(fd)
+			if err != nil {
+				log.Printf("close(%d) faile: %v", fd, err)
+			}
+			delete(r.FdsInfo, fd)
+		}
+		r.Timers.Stop(conn.Race.Timer)
+		conn.Race = nil
+	}
+	if conn.UDPRelayFD >= 0 {
+		EpollDel(r, conn.UDPRelayFD)
+		err := unix.Close(conn.UDPRelayFD)
+		if err != nil {
+			log.Printf("close(%d) faile: %v", conn.UDPRelayFD, err)
+		}
+		delete(r.FdsInfo, conn.UDPRelayFD)
+		conn.UDPRelayFD = -1
+	}
+	closePipes(conn)
+	conn.HandshakeBuffer = bytes.Buffer{}
+	conn.ClientToUpstreamBuffer.Reset()
+	conn.UpstreamToClientBuffer.Reset()
+	r.Timers.Stop(conn.Deadline)
+	conn.Deadline = nil
+	r.Timers.Stop(conn.ClientThrottle)
+	r.Timers.Stop(conn.UpstreamThrottle)
+	conn.ClientThrottle, conn.UpstreamThrottle = nil, nil
+	if conn.Limits != nil {
+		conn.Limits.Release()
+		conn.Limits = nil
+	}
 }
 
-func SendSocksReply(conn *data.Conn, rep byte, atyp byte, bndAddr []byte, bndPort int) bool {
+// ReplyForError picks the reply code for a failed connect(2) to the destination.
+func ReplyForError(err error) byte {
+	switch {
+	case errors.Is(err, unix.ECONNREFUSED):
+		return data.RepConnectionRefused
+	case errors.Is(err, unix.ENETUNREACH), errors.Is(err, unix.ENETDOWN):
+		return data.RepNetworkUnreachable
+	case errors.Is(err, unix.EHOSTUNREACH), errors.Is(err, unix.EHOSTDOWN):
+		return data.RepHostUnreachable
+	case errors.Is(err, unix.ETIMEDOUT):
+		return data.RepTTLExpired
+	case errors.Is(err, unix.EACCES), errors.Is(err, unix.EPERM):
+		return data.RepConnectionNotAllowed
+	case errors.Is(err, unix.EAFNOSUPPORT):
+		return data.RepAddrTypeNotSupported
+	}
+	return data.RepGeneralFailure
+}
+
+// SendAddrReply sends a success reply carrying a bound or peer address.
+func SendAddrReply(r *data.Reactor, conn *data.Conn, ip net.IP, port int) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		return SendSocksReply(r, conn, data.RepSuccess, data.AtypIPv4, ip4, port)
+	}
+	return SendSocksReply(r, conn, data.RepSuccess, data.AtypIPv6, ip.To16(), port)
+}
+
+func SendSocksReply(r *data.Reactor, conn *data.Conn, rep byte, atyp byte, bndAddr []byte, bndPort int) bool {
+	r.Stats.Replies[rep]++
+	conn.Reply, conn.Replied = rep, true
+	switch conn.Protocol {
+	case data.ProtocolHTTP:
+		return sendHTTPReply(r, conn, rep)
+	case data.ProtocolSocks4:
+		return sendSocks4Reply(r, conn, rep, bndAddr, bndPort)
+	}
 	if bndAddr == nil {
-		bndAddr = []byte{0, 0, 0, 0}
+		atyp, bndAddr = data.AtypIPv4, []byte{0, 0, 0, 0}
 	}
 	resp := []byte{data.SocksVer, rep, 0x00, atyp}
 	resp = append(resp, bndAddr...)
 	portb := make([]byte, 2)
 	binary.BigEndian.PutUint16(portb, uint16(bndPort))
 	resp = append(resp, portb...)
-	return WriteAll(conn, conn.ClientFD, resp, false)
+	return WriteAll(r, conn, conn.ClientFD, resp, false)
 }
 
-func WriteAll(conn *data.Conn, fd int, data []byte, isClientToUpstream bool) bool {
+// sendSocks4Reply writes the 8-byte SOCKS4 reply; SOCKS4 has a single failure code and no room
+// for an IPv6 address.
+func sendSocks4Reply(r *data.Reactor, conn *data.Conn, rep byte, bndAddr []byte, bndPort int) bool {
+	resp := []byte{data.Socks4ReplyVer, data.Socks4RepGranted, 0, 0, 0, 0, 0, 0}
+	if rep != data.RepSuccess {
+		resp[1] = data.Socks4RepRejected
+	}
+	binary.BigEndian.PutUint16(resp[2:], uint16(bndPort))
+	if len(bndAddr) == 4 {
+		copy(resp[4:], bndAddr)
+	}
+	return WriteAll(r, conn, conn.ClientFD, resp, false)
+}
+
+func WriteAll(r *data.Reactor, conn *data.Conn, fd int, data []byte, isClientToUpstream bool) bool {
 	off := 0
 	for off < len(data) {
 		n, err := unix.Write(fd, data[off:])
@@ -78,10 +190,11 @@ func WriteAll(conn *data.Conn, fd int, data []byte, isClientToUpstream bool) boo
 					remaining := data[off:]
 					if isClientToUpstream {
 						conn.ClientToUpstreamBuffer.Write(remaining)
+						UpdateUpstreamEvents(r, conn)
 					} else {
 						conn.UpstreamToClientBuffer.Write(remaining)
+						UpdateClientEvents(r, conn)
 					}
-					_ = EpollMod(fd, unix.EPOLLIN|unix.EPOLLOUT)
 				}
 				return true
 			}
@@ -90,3 +203,84 @@ func WriteAll(conn *data.Conn, fd int, data []byte, isClientToUpstream bool) boo
 	}
 	return true
 }
+
+// UpdateClientEvents polls the client for reading unless flow control or shaping paused it and for writing
+// while data for it is pending.
+func UpdateClientEvents(r *data.Reactor, conn *data.Conn) {
+	if conn.ClientFD < 0 {
+		return
+	}
+	conn.ClientReadPaused = readPaused(conn.ClientReadPaused, conn.ClientToUpstreamBuffer.Len()) || pipeFull(conn.ClientToUpstreamPipe)
+	if conn.EdgeTriggered {
+		updateEdge(r, conn)
+		return
+	}
+	wantWrite := conn.UpstreamToClientBuffer.Len() > 0 || PipePending(conn.UpstreamToClientPipe) > 0
+	epollSet(r, conn.ClientFD, pollEvents(conn.ClientReadPaused || conn.ClientThrottled || conn.ClientClosed || conn.AuthPending, wantWrite))
+}
+
+func UpdateUpstreamEvents(r *data.Reactor, conn *data.Conn) {
+	if conn.UpstreamFD < 0 {
+		return
+	}
+	conn.UpstreamReadPaused = readPaused(conn.UpstreamReadPaused, conn.UpstreamToClientBuffer.Len()) || pipeFull(conn.UpstreamToClientPipe)
+	if conn.EdgeTriggered {
+		updateEdge(r, conn)
+		return
+	}
+	wantWrite := conn.ClientToUpstreamBuffer.Len() > 0 || PipePending(conn.ClientToUpstreamPipe) > 0 || conn.State == data.StateConnecting
+	if conn.State == data.StateChaining {
+		// What the client pipelined waits for the tunnel; only the handshake with the parent is written.
+		wantWrite = len(conn.Chain.Out) > 0
+	}
+	epollSet(r, conn.UpstreamFD, pollEvents(conn.UpstreamReadPaused || conn.UpstreamThrottled || conn.UpstreamClosed, wantWrite))
+}
+
+// epollSet re-adds descriptors that Hangup removed from epoll.
+func epollSet(r *data.Reactor, fd int, events uint32) {
+	if err := EpollMod(r, fd, events); errors.Is(err, unix.ENOENT) {
+		_ = EpollAdd(r, fd, events)
+	}
+}
+
+func readPaused(paused bool, buffered int) bool {
+	if buffered >= data.BufferHighWatermark {
+		return true
+	}
+	if buffered < data.BufferLowWatermark {
+		return false
+	}
+	return paused
+}
+
+func pollEvents(readPaused bool, wantWrite bool) uint32 {
+	var events uint32
+	if !readPaused {
+		events |= unix.EPOLLIN
+	}
+	if wantWrite {
+		events |= unix.EPOLLOUT
+	}
+	return events
+}
+
+func IPToSockaddr(ip net.IP, port int, isIPv6 bool) unix.Sockaddr {
+	if isIPv6 {
+		sa6 := &unix.SockaddrInet6{Port: port}
+		copy(sa6.Addr[:], ip.To16())
+		return sa6
+	}
+	sa4 := &unix.SockaddrInet4{Port: port}
+	copy(sa4.Addr[:], ip.To4())
+	return sa4
+}
+
+func SockaddrToIP(sa unix.Sockaddr) (net.IP, int) {
+	switch addr := sa.(type) {
+	case *unix.SockaddrInet4:
+		return net.IP(addr.Addr[:]), addr.Port
+	case *unix.SockaddrInet6:
+		return net.IP(addr.Addr[:]), addr.Port
+	}
+	return nil, 0
+}
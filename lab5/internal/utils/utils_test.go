@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"errors"
+	"lab5/internal/bufferPool"
+	"lab5/internal/data"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestReadPausedWatermarks(t *testing.T) {
+	q := bufferPool.NewQueue(bufferPool.New(0))
+	fill := make([]byte, 64*1024)
+	paused := false
+	// Each step writes n bytes, or drains -n bytes when n is negative.
+	steps := []struct {
+		name   string
+		n      int
+		paused bool
+	}{
+		{"below the high watermark", data.BufferHighWatermark - 1, false},
+		{"at the high watermark", 1, true},
+		{"above the high watermark", 64 * 1024, true},
+		{"drained to the low watermark", -(data.BufferHighWatermark + 64*1024 - data.BufferLowWatermark), true},
+		{"below the low watermark", -1, false},
+		{"refilled between the watermarks", data.BufferHighWatermark / 2, false},
+		{"back at the high watermark", data.BufferHighWatermark - data.BufferLowWatermark + 1 - data.BufferHighWatermark/2, true},
+		{"drained between the watermarks", -(data.BufferHighWatermark - data.BufferHighWatermark/2), true},
+		{"empty", -(data.BufferHighWatermark / 2), false},
+	}
+	for _, step := range steps {
+		for n := step.n; n > 0; n -= len(fill) {
+			q.Write(fill[:min(n, len(fill))])
+		}
+		if step.n < 0 {
+			q.Next(-step.n)
+		}
+		paused = readPaused(paused, q.Len())
+		if paused != step.paused {
+			t.Errorf("%s (%d buffered): paused = %v; want %v", step.name, q.Len(), paused, step.paused)
+		}
+	}
+	if q.Len() != 0 {
+		t.Errorf("%d bytes left", q.Len())
+	}
+}
+
+func TestCleanupClosesResolveSockets(t *testing.T) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("socket: %v", err)
+	}
+	r := data.NewReactor()
+	p := &data.PendingResolve{TCPFD: fd}
+	r.FdsInfo[fd] = &data.FDInfo{Resolve: p}
+
+	CleanupAllConnections(r)
+	if _, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0); !errors.Is(err, unix.EBADF) {
+		_ = unix.Close(fd)
+		t.Fatalf("fd %d still open", fd)
+	}
+	if p.TCPFD != -1 || len(r.FdsInfo) != 0 {
+		t.Errorf("TCPFD %d, %d fds left", p.TCPFD, len(r.FdsInfo))
+	}
+}